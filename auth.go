@@ -31,6 +31,17 @@ type KeyboardInteractiveChallenge func(name, instruction string, questions []str
 // PublicKeyCallback ssh 包下定义的公钥认证回调函数类型的包装
 type PublicKeyCallback func(conn ConnMetadata, key PublicKey) (*Permissions, error)
 
+// VerifiedPublicKeyCallback 两阶段公钥认证的第二阶段，在客户端通过签名证明持有私钥之后调用；
+// perms 为第一阶段返回的 Permissions，返回的 Permissions 将代替其存入 Context，返回 error 时终止连接
+type VerifiedPublicKeyCallback func(conn ConnMetadata, key PublicKey, perms *Permissions) (*Permissions, error)
+
+// PubKeyFingerprintExtension 公钥认证成功后，Permissions 的 Extensions 中保存认证所用公钥的 SHA256 指纹的键，
+// 格式与 ssh.FingerprintSHA256 相同，可通过 Context 的 Extension 方法读取
+const PubKeyFingerprintExtension = "pubkey-fingerprint"
+
+// PublicKeyExtension 两阶段公钥认证中，Permissions 的 Extensions 中保存认证所用公钥（ssh 线路格式）的键
+const PublicKeyExtension = "publickey@gosshd"
+
 // PasswdCallback ssh 包下定义的密码认证回调函数类型的包装
 type PasswdCallback func(conn ConnMetadata, password []byte) (*Permissions, error)
 
@@ -84,7 +95,8 @@ func WrapKeyboardInteractiveChallenger(callback KeyboardInteractiveChallengeCall
 	}
 }
 
-// WrapPublicKeyCallback  生成 ssh.ServerConfig 可接受的参数：PublicKeyCallback
+// WrapPublicKeyCallback  生成 ssh.ServerConfig 可接受的参数：PublicKeyCallback；
+// 认证成功时在 Extensions 中添加 PubKeyFingerprintExtension
 func WrapPublicKeyCallback(callback PublicKeyCallback) func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
 	if callback == nil {
 		return nil
@@ -94,13 +106,15 @@ func WrapPublicKeyCallback(callback PublicKeyCallback) func(conn ssh.ConnMetadat
 		if err != nil {
 			return nil, err
 		}
+		permissions := &ssh.Permissions{Extensions: map[string]string{}}
 		if perms != nil {
-			permissions := &ssh.Permissions{}
-			permissions.Extensions = perms.Extensions
+			for k, v := range perms.Extensions {
+				permissions.Extensions[k] = v
+			}
 			permissions.CriticalOptions = perms.CriticalOptions
-			return permissions, nil
 		}
-		return nil, err
+		permissions.Extensions[PubKeyFingerprintExtension] = ssh.FingerprintSHA256(key)
+		return permissions, nil
 	}
 }
 
@@ -1,6 +1,14 @@
 package gosshd
 
-import "golang.org/x/crypto/ssh"
+import (
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"net"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+)
 
 // RFC 4254 规定的 4 种 channel 类型
 const (
@@ -24,6 +32,47 @@ type SSHConn interface {
 	ssh.Conn
 }
 
+// ConnInfo 已建立的 SSH 连接的信息，由 SSHServer 的 ActiveConns 方法返回
+type ConnInfo struct {
+	SessionID     string // hex 编码的会话标识，可用于 SSHServer 的 Disconnect 方法
+	User          string // 用户名
+	RemoteAddr    net.Addr
+	LocalAddr     net.Addr
+	ClientVersion string
+	ConnectedAt   time.Time // 连接建立的时间
+	BytesIn       uint64    // 从客户端接收的字节数，为网络连接上传输的数据量，包括 SSH 协议的开销
+	BytesOut      uint64    // 发送至客户端的字节数，为网络连接上传输的数据量，包括 SSH 协议的开销
+}
+
+// countingConn 统计网络连接读取与写入的字节数
+type countingConn struct {
+	net.Conn
+	in  uint64
+	out uint64
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddUint64(&c.in, uint64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddUint64(&c.out, uint64(n))
+	return n, err
+}
+
+// BytesIn 已读取的字节数
+func (c *countingConn) BytesIn() uint64 {
+	return atomic.LoadUint64(&c.in)
+}
+
+// BytesOut 已写入的字节数
+func (c *countingConn) BytesOut() uint64 {
+	return atomic.LoadUint64(&c.out)
+}
+
 type NewChannel interface {
 	ssh.NewChannel
 }
@@ -32,8 +81,36 @@ type Channel interface {
 	ssh.Channel
 }
 
+// SSHNewChannel 与 SSHChannel 为旧版文档中使用的名称，与 NewChannel、Channel 为同一类型
+type (
+	SSHNewChannel = NewChannel
+	SSHChannel    = Channel
+)
+
+// NewChannelHandleFunc channel 建立请求的处理函数，与其它回调函数一致，第一个参数总是 Context
 type NewChannelHandleFunc func(ctx Context, channel NewChannel)
 
+// wrapRequests 将 ssh 包的 Request 包装为 Request，in 被关闭或 ctx 被取消时关闭返回的 channel；
+// ctx 被取消后未传递的请求将被拒绝
+func wrapRequests(ctx Context, in <-chan *ssh.Request) <-chan *Request {
+	out := make(chan *Request)
+	go func() {
+		defer close(out)
+		for req := range in {
+			select {
+			case out <- &Request{Request: req}:
+			case <-ctx.Done():
+				if req.WantReply {
+					req.Reply(false, nil)
+				}
+				go ssh.DiscardRequests(in)
+				return
+			}
+		}
+	}()
+	return out
+}
+
 // DiscardRequests 拒绝所有的 Request，可由 ctx 取消执行
 func DiscardRequests(ctx Context, in <-chan *ssh.Request) {
 	for {
@@ -54,3 +131,54 @@ func DiscardRequests(ctx Context, in <-chan *ssh.Request) {
 		}
 	}
 }
+
+// RecoverPanic 应该在处理协程中以 defer 的方式调用，恢复处理函数中发生的 panic，
+// 调用 ctx 所属的 SSHServer 的 PanicCallback 进行记录，然后执行 cleanup 释放对应的资源
+func RecoverPanic(ctx Context, cleanup func()) {
+	value := recover()
+	if value == nil {
+		return
+	}
+	if server := ctx.Server(); server != nil && server.PanicCallback != nil {
+		server.PanicCallback(ctx, value, debug.Stack())
+	}
+	if cleanup != nil {
+		cleanup()
+	}
+}
+
+// recoverableNewChannel 记录 Accept 返回的 Channel，以便处理函数发生 panic 时关闭该 Channel
+type recoverableNewChannel struct {
+	ssh.NewChannel
+	sync.Mutex
+	channel  ssh.Channel
+	answered bool
+}
+
+func (c *recoverableNewChannel) Accept() (ssh.Channel, <-chan *ssh.Request, error) {
+	c.Lock()
+	defer c.Unlock()
+	channel, requests, err := c.NewChannel.Accept()
+	c.answered = true
+	c.channel = channel
+	return channel, requests, err
+}
+
+func (c *recoverableNewChannel) Reject(reason ssh.RejectionReason, message string) error {
+	c.Lock()
+	defer c.Unlock()
+	c.answered = true
+	return c.NewChannel.Reject(reason, message)
+}
+
+// abort 关闭已经建立的 Channel；若 Channel 尚未被接受或拒绝，则拒绝该请求
+func (c *recoverableNewChannel) abort() {
+	c.Lock()
+	defer c.Unlock()
+	if c.channel != nil {
+		c.channel.Close()
+	} else if !c.answered {
+		c.answered = true
+		c.NewChannel.Reject(ssh.ConnectionFailed, fmt.Sprintf("%s handler failed", c.ChannelType()))
+	}
+}
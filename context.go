@@ -5,6 +5,7 @@ import (
 	"golang.org/x/crypto/ssh"
 	"net"
 	"sync"
+	"time"
 )
 
 // Context 包含各类 handler 所需信息以及一个 context.Context ，必要信息应该保证在 handler 调用之前被添加。
@@ -22,17 +23,37 @@ type Context interface {
 	SetLocalAddr(addr net.Addr)
 	SetRemoteAddr(addr net.Addr)
 	SetUser(user *User)
+	SetAlgorithms(algos NegotiatedAlgorithms)
 
 	User() *User
 	ClientVersion() string
 	ServerVersion() string
 	RemoteAddr() net.Addr
+	// RemoteHost 返回客户端的主机名，只有开启了 SSHServer 的 UseDNS 时才会进行反向解析，否则返回 ip 地址
+	RemoteHost() string
 	LocalAddr() net.Addr
+	// Algorithms 返回握手时协商的算法，可用于审计日志
+	Algorithms() NegotiatedAlgorithms
+	// CipherName 返回协商的客户端至服务端方向的加密算法
+	CipherName() string
+	// MACName 返回协商的客户端至服务端方向的消息摘要算法，服务端至客户端方向的算法见 Algorithms
+	MACName() string
+	// KexName 返回协商的密钥交换算法
+	KexName() string
+	// RawSessionID 返回原始字节形式的会话标识
+	RawSessionID() []byte
 
 	// Permissions 用于身份验证回调函数的返回值，包含用户的权限信息，取决于具体的身份认证 callback 实现
 	Permissions() *Permissions
+	// Extension 返回 Permissions 的 Extensions 中 key 对应的值，例如 PubKeyFingerprintExtension
+	Extension(key string) (string, bool)
 	Conn() ssh.Conn
 	Server() *SSHServer
+
+	// Disconnect 关闭该 SSH 连接，不会向客户端发送 SSH_MSG_DISCONNECT
+	Disconnect() error
+	// OpenChannel 由服务端向客户端发起 channel 建立请求，可用于服务端推送等场景
+	OpenChannel(chType string, extra []byte) (Channel, <-chan *Request, error)
 }
 
 // SSHContext 基本的上下文
@@ -46,12 +67,23 @@ type SSHContext struct {
 	raddr       net.Addr
 	conn        ssh.Conn
 	user        *User
+	algos       NegotiatedAlgorithms
 	server      *SSHServer
+
+	hostOnce sync.Once
+	rhost    string
+
+	valuesMu sync.RWMutex // 与 Mutex 分开，使持有 Mutex 的处理器仍然可以读取值
+	values   map[interface{}]interface{}
 }
 
-// NewContext 创建一个 SSHContext
+// NewContext 创建一个 SSHContext，sshd 不为 nil 时从服务器的根 Context 派生，随 Shutdown 一起被取消
 func NewContext(sshd *SSHServer) (Context, context.CancelFunc) {
-	innerCtx, cancel := context.WithCancel(context.Background())
+	parent := context.Background()
+	if sshd != nil {
+		parent = sshd.Context()
+	}
+	innerCtx, cancel := context.WithCancel(parent)
 	ctx := &SSHContext{
 		Context: innerCtx,
 		Mutex:   sync.Mutex{},
@@ -93,11 +125,29 @@ func (ctx *SSHContext) SetUser(user *User) {
 	ctx.user = user
 }
 
-// SetValue 设置值，会上锁
+func (ctx *SSHContext) SetAlgorithms(algos NegotiatedAlgorithms) {
+	ctx.algos = algos
+}
+
+// SetValue 设置值，保存在 map 中而不是创建新的 context.Context，所以重复设置不会使 Value 的查找变慢
 func (ctx *SSHContext) SetValue(key, value interface{}) {
-	ctx.Lock()
-	defer ctx.Unlock()
-	ctx.Context = context.WithValue(ctx.Context, key, value)
+	ctx.valuesMu.Lock()
+	defer ctx.valuesMu.Unlock()
+	if ctx.values == nil {
+		ctx.values = make(map[interface{}]interface{})
+	}
+	ctx.values[key] = value
+}
+
+// Value 先查找通过 SetValue 设置的值，再查找内部的 context.Context
+func (ctx *SSHContext) Value(key interface{}) interface{} {
+	ctx.valuesMu.RLock()
+	value, ok := ctx.values[key]
+	ctx.valuesMu.RUnlock()
+	if ok {
+		return value
+	}
+	return ctx.Context.Value(key)
 }
 
 func (ctx *SSHContext) User() *User {
@@ -108,6 +158,31 @@ func (ctx *SSHContext) SessionID() string {
 	return string(ctx.conn.SessionID())
 }
 
+// RawSessionID 返回原始字节形式的会话标识
+func (ctx *SSHContext) RawSessionID() []byte {
+	return ctx.conn.SessionID()
+}
+
+func (ctx *SSHContext) Algorithms() NegotiatedAlgorithms {
+	return ctx.algos
+}
+
+// CipherName 返回协商的客户端至服务端方向的加密算法
+func (ctx *SSHContext) CipherName() string {
+	return ctx.algos.Cipher
+}
+
+// MACName 返回协商的客户端至服务端方向的消息摘要算法，使用 AEAD 加密算法时为空；
+// 服务端至客户端方向的算法为 Algorithms 的 MACServerClient，两个方向的算法通常相同
+func (ctx *SSHContext) MACName() string {
+	return ctx.algos.MAC
+}
+
+// KexName 返回协商的密钥交换算法
+func (ctx *SSHContext) KexName() string {
+	return ctx.algos.Kex
+}
+
 func (ctx *SSHContext) ClientVersion() string {
 	return ctx.cversion
 }
@@ -120,6 +195,14 @@ func (ctx *SSHContext) RemoteAddr() net.Addr {
 	return ctx.raddr
 }
 
+// RemoteHost 第一次调用时解析客户端的主机名，之后返回相同的结果
+func (ctx *SSHContext) RemoteHost() string {
+	ctx.hostOnce.Do(func() {
+		ctx.rhost = ctx.server.RemoteHost(ctx, ctx.raddr)
+	})
+	return ctx.rhost
+}
+
 func (ctx *SSHContext) LocalAddr() net.Addr {
 	return ctx.laddr
 }
@@ -128,6 +211,14 @@ func (ctx *SSHContext) Permissions() *Permissions {
 	return ctx.permissions
 }
 
+func (ctx *SSHContext) Extension(key string) (string, bool) {
+	if ctx.permissions == nil || ctx.permissions.Extensions == nil {
+		return "", false
+	}
+	value, ok := ctx.permissions.Extensions[key]
+	return value, ok
+}
+
 func (ctx *SSHContext) Conn() ssh.Conn {
 	return ctx.conn
 }
@@ -135,3 +226,81 @@ func (ctx *SSHContext) Conn() ssh.Conn {
 func (ctx *SSHContext) Server() *SSHServer {
 	return ctx.server
 }
+
+// Disconnect 直接关闭该 SSH 连接，并取消该连接的 Context，客户端只会看到连接被关闭。
+// 握手完成之后传输已被加密，ssh 包没有提供发送 SSH_MSG_DISCONNECT 的方法，所以无法向客户端说明原因；
+// 需要让客户端收到原因时，应该在握手之前通过 SSHServer 的 RejectWithDisconnect 拒绝连接；
+// 身份认证失败次数超过 MaxAuthTries 时，ssh 包会自行发送 SSH_MSG_DISCONNECT
+func (ctx *SSHContext) Disconnect() error {
+	if ctx.conn == nil {
+		return ConnNotFoundErr
+	}
+	if ctx.server != nil {
+		ctx.server.DelSSHConn(ctx.conn)
+	}
+	return ctx.conn.Close()
+}
+
+// OpenChannel 通过该连接向客户端发起 chType 类型的 channel 建立请求，extra 为类型相关的数据；
+// 返回的 Request channel 必须被持续读取，或者交由 DiscardRequests 处理，否则会阻塞该连接；Context 被取消后不再传递请求
+func (ctx *SSHContext) OpenChannel(chType string, extra []byte) (Channel, <-chan *Request, error) {
+	if ctx.conn == nil {
+		return nil, nil, ConnNotFoundErr
+	}
+	channel, requests, err := ctx.conn.OpenChannel(chType, extra)
+	if err != nil {
+		return nil, nil, err
+	}
+	return channel, wrapRequests(ctx, requests), nil
+}
+
+// WithCancel 类似于 context.WithCancel，返回一个可以单独取消的 Context 以及对应的 cancel 函数；
+// 返回的 Context 与 parent 共享连接相关的信息，parent 被取消时其也会被取消；
+// 通过 SetValue 设置的值只对返回的 Context 可见，但可以读取 parent 中的值；
+// 可用于单个 session 等作用域小于整个连接的处理过程
+func WithCancel(parent Context) (Context, context.CancelFunc) {
+	inner, cancel := context.WithCancel(parent)
+	return &childContext{Context: parent, inner: inner}, cancel
+}
+
+// childContext 使用 inner 作为 context.Context 的实现，其余方法由 parent 实现
+type childContext struct {
+	Context
+	inner context.Context
+
+	mu     sync.RWMutex
+	values map[interface{}]interface{}
+}
+
+func (ctx *childContext) Deadline() (deadline time.Time, ok bool) {
+	return ctx.inner.Deadline()
+}
+
+func (ctx *childContext) Done() <-chan struct{} {
+	return ctx.inner.Done()
+}
+
+func (ctx *childContext) Err() error {
+	return ctx.inner.Err()
+}
+
+// Value 先查找通过 SetValue 设置的值，再查找 parent 中的值
+func (ctx *childContext) Value(key interface{}) interface{} {
+	ctx.mu.RLock()
+	value, ok := ctx.values[key]
+	ctx.mu.RUnlock()
+	if ok {
+		return value
+	}
+	return ctx.inner.Value(key)
+}
+
+// SetValue 设置只对该 Context 可见的值
+func (ctx *childContext) SetValue(key, value interface{}) {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	if ctx.values == nil {
+		ctx.values = make(map[interface{}]interface{})
+	}
+	ctx.values[key] = value
+}
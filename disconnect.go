@@ -0,0 +1,91 @@
+package gosshd
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"io/ioutil"
+	"net"
+	"time"
+)
+
+// SSH_MSG_DISCONNECT 的原因，See RFC 4253, section 11.1.
+const (
+	DisconnectHostNotAllowedToConnect     uint32 = 1
+	DisconnectProtocolError               uint32 = 2
+	DisconnectKeyExchangeFailed           uint32 = 3
+	DisconnectReserved                    uint32 = 4
+	DisconnectMacError                    uint32 = 5
+	DisconnectCompressionError            uint32 = 6
+	DisconnectServiceNotAvailable         uint32 = 7
+	DisconnectProtocolVersionNotSupported uint32 = 8
+	DisconnectHostKeyNotVerifiable        uint32 = 9
+	DisconnectConnectionLost              uint32 = 10
+	DisconnectByApplication               uint32 = 11
+	DisconnectTooManyConnections          uint32 = 12
+	DisconnectAuthCancelledByUser         uint32 = 13
+	DisconnectNoMoreAuthMethodsAvailable  uint32 = 14
+	DisconnectIllegalUserName             uint32 = 15
+)
+
+// disconnectMsg See RFC 4253, section 11.1.
+type disconnectMsg struct {
+	Reason   uint32 `sshtype:"1"`
+	Message  string
+	Language string
+}
+
+// DisconnectSentErr RejectWithDisconnect 发送 SSH_MSG_DISCONNECT 之后返回的错误，可作为 TransformConnCallback 的返回值
+var DisconnectSentErr = errors.New("disconnect sent")
+
+// RejectWithDisconnect 在 SSH 握手之前拒绝连接：发送服务端版本号以及未加密的 SSH_MSG_DISCONNECT 消息，然后关闭连接，
+// 客户端会显示 reason 与 message，例如 OpenSSH 的 "Received disconnect from ...: 12: too many connections"；
+// 通常在 TransformConnCallback 中用于连接数限制、频率限制等，例如：
+//
+//	sshd.TransformConnCallback = func(conn net.Conn) (net.Conn, error) {
+//		if !limiter.Allow() {
+//			return nil, sshd.RejectWithDisconnect(conn, gosshd.DisconnectTooManyConnections, "too many connections")
+//		}
+//		return conn, nil
+//	}
+//
+// 返回的 error 为写入失败的原因，或者 DisconnectSentErr
+func (sshd *SSHServer) RejectWithDisconnect(conn net.Conn, reason uint32, message string) error {
+	defer conn.Close()
+	version := sshd.ServerVersion
+	if version == "" {
+		version = Version2 + "GoSSHD"
+	}
+	packet := append([]byte(version+"\r\n"), disconnectPacket(reason, message)...)
+	if _, err := conn.Write(packet); err != nil {
+		return err
+	}
+	// 直接关闭仍有未读数据的连接会发送 RST，客户端可能来不及读取消息，所以先读取并丢弃客户端发送的数据，直到客户端关闭连接
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	}
+	conn.SetReadDeadline(time.Now().Add(disconnectLinger))
+	io.Copy(ioutil.Discard, conn)
+	return DisconnectSentErr
+}
+
+// 发送 SSH_MSG_DISCONNECT 之后等待客户端关闭连接的最长时间
+const disconnectLinger = 2 * time.Second
+
+// disconnectPacket 生成未加密的 SSH_MSG_DISCONNECT 数据包，See RFC 4253, section 6.
+func disconnectPacket(reason uint32, message string) []byte {
+	payload := ssh.Marshal(&disconnectMsg{Reason: reason, Message: message})
+	const blockSize = 8
+	padding := blockSize - (5+len(payload))%blockSize
+	if padding < 4 {
+		padding += blockSize
+	}
+	packet := make([]byte, 5+len(payload)+padding)
+	binary.BigEndian.PutUint32(packet, uint32(1+len(payload)+padding))
+	packet[4] = byte(padding)
+	copy(packet[5:], payload)
+	rand.Read(packet[5+len(payload):])
+	return packet
+}
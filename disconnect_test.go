@@ -0,0 +1,48 @@
+package gosshd
+
+import (
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"net"
+	"strings"
+	"testing"
+)
+
+// asyncWriteConn 在单独的协程中写入数据；net.Pipe 没有缓冲，而双方交换版本号时都是先写后读，同步写入将导致死锁
+type asyncWriteConn struct {
+	net.Conn
+}
+
+func (c asyncWriteConn) Write(b []byte) (int, error) {
+	buf := append([]byte(nil), b...)
+	go c.Conn.Write(buf)
+	return len(b), nil
+}
+
+// TestRejectWithDisconnect 客户端应当收到 RejectWithDisconnect 发送的原因与消息
+func TestRejectWithDisconnect(t *testing.T) {
+	sshd := NewSSHServer()
+	server, client := net.Pipe()
+	defer client.Close()
+	const message = "too many connections"
+	rejected := make(chan error, 1)
+	go func() {
+		rejected <- sshd.RejectWithDisconnect(server, DisconnectTooManyConnections, message)
+	}()
+
+	_, _, _, err := ssh.NewClientConn(asyncWriteConn{client}, "pipe", &ssh.ClientConfig{
+		User:            "test",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err == nil {
+		t.Fatal("handshake succeeded")
+	}
+	want := fmt.Sprintf("reason %d: %s", DisconnectTooManyConnections, message)
+	if !strings.Contains(err.Error(), want) {
+		t.Fatalf("err = %v, want it to contain %q", err, want)
+	}
+	client.Close()
+	if err := <-rejected; err != DisconnectSentErr {
+		t.Fatalf("RejectWithDisconnect returned %v, want DisconnectSentErr", err)
+	}
+}
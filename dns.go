@@ -0,0 +1,111 @@
+package gosshd
+
+import (
+	"context"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	defaultDNSTimeout = 5 * time.Second // 未设置 DNSTimeout 时反向解析的最长时间
+	dnsCacheTTL       = 5 * time.Minute // 反向解析结果的缓存时间
+	dnsCacheSize      = 1024            // 缓存条目超过该数量时清理过期的条目
+)
+
+type dnsCacheEntry struct {
+	host    string
+	expires time.Time
+}
+
+// RemoteHost 返回 addr 对应的主机名；sshd 为 nil 或未开启 UseDNS、addr 不是 ip 地址或者解析失败时返回 ip 地址。
+// 与 OpenSSH 的 UseDNS 相同，反向解析得到的主机名需要正向解析回该 ip 地址，以防止伪造的 PTR 记录；
+// 解析结果会被缓存一段时间，单次解析的时间不超过 DNSTimeout
+func (sshd *SSHServer) RemoteHost(ctx context.Context, addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	ip := addrIP(addr)
+	if ip == nil {
+		return addr.String()
+	}
+	if sshd == nil || !sshd.UseDNS {
+		return ip.String()
+	}
+	key := ip.String()
+	sshd.Lock()
+	entry, ok := sshd.dnsCache[key]
+	sshd.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.host
+	}
+
+	timeout := sshd.DNSTimeout
+	if timeout <= 0 {
+		timeout = defaultDNSTimeout
+	}
+	c, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	host := verifiedHostname(c, ip)
+	if host == "" {
+		host = key
+	}
+
+	sshd.Lock()
+	defer sshd.Unlock()
+	if sshd.dnsCache == nil || len(sshd.dnsCache) >= dnsCacheSize {
+		sshd.pruneDNSCache()
+	}
+	sshd.dnsCache[key] = dnsCacheEntry{host: host, expires: time.Now().Add(dnsCacheTTL)}
+	return host
+}
+
+// pruneDNSCache 删除过期的缓存条目，仍然过多时清空缓存；调用时需要持有锁
+func (sshd *SSHServer) pruneDNSCache() {
+	if sshd.dnsCache == nil {
+		sshd.dnsCache = make(map[string]dnsCacheEntry)
+		return
+	}
+	now := time.Now()
+	for key, entry := range sshd.dnsCache {
+		if now.After(entry.expires) {
+			delete(sshd.dnsCache, key)
+		}
+	}
+	if len(sshd.dnsCache) >= dnsCacheSize {
+		sshd.dnsCache = make(map[string]dnsCacheEntry)
+	}
+}
+
+// verifiedHostname 反向解析 ip，返回第一个正向解析结果包含 ip 的主机名，没有时返回空字符串
+func verifiedHostname(ctx context.Context, ip net.IP) string {
+	names, err := net.DefaultResolver.LookupAddr(ctx, ip.String())
+	if err != nil {
+		return ""
+	}
+	for _, name := range names {
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, name)
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if addr.IP.Equal(ip) {
+				return strings.TrimSuffix(name, ".")
+			}
+		}
+	}
+	return ""
+}
+
+// addrIP 返回 tcp、udp 地址中的 ip，其它类型的地址返回 nil
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	case *net.IPAddr:
+		return a.IP
+	}
+	return nil
+}
@@ -3,6 +3,8 @@ package gosshd
 import (
 	"fmt"
 	"runtime"
+	"sort"
+	"strings"
 )
 
 type PlatformNotSupportError struct {
@@ -28,3 +30,39 @@ type UserNotExistError struct {
 func (e UserNotExistError) Error() string {
 	return fmt.Sprintf("%s not exists", e.User)
 }
+
+type UnsupportedAlgorithmError struct {
+	Kind      string
+	Algorithm string
+}
+
+func (e UnsupportedAlgorithmError) Error() string {
+	return fmt.Sprintf("unsupported %s algorithm: %s", e.Kind, e.Algorithm)
+}
+
+// HostKeyLoadError 加载多个主机密钥时，加载失败的文件路径与原因
+type HostKeyLoadError struct {
+	Failures map[string]error
+}
+
+func (e HostKeyLoadError) Error() string {
+	paths := make([]string, 0, len(e.Failures))
+	for path := range e.Failures {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	msgs := make([]string, 0, len(paths))
+	for _, path := range paths {
+		msgs = append(msgs, fmt.Sprintf("%s: %s", path, e.Failures[path]))
+	}
+	return fmt.Sprintf("failed to load host keys: %s", strings.Join(msgs, "; "))
+}
+
+// ConfigError Validate 发现的所有配置问题
+type ConfigError struct {
+	Problems []string
+}
+
+func (e ConfigError) Error() string {
+	return fmt.Sprintf("invalid server config: %s", strings.Join(e.Problems, "; "))
+}
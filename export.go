@@ -1,5 +1,7 @@
 package gosshd
 
+import "golang.org/x/crypto/ssh"
+
 // ssh 包导出的算法密码学名称
 
 // SupportedCiphers 支持的加密算法
@@ -48,3 +50,58 @@ const (
 var SupportedMACs = []string{
 	"hmac-sha2-256-etm@openssh.com", "hmac-sha2-256", "hmac-sha1", "hmac-sha1-96",
 }
+
+// SupportedKexAlgos 支持的密钥交换算法
+var SupportedKexAlgos = []string{
+	kexAlgoCurve25519SHA256, kexAlgoCurve25519SHA256LibSSH,
+	kexAlgoECDH256, kexAlgoECDH384, kexAlgoECDH521,
+	kexAlgoDH14SHA256, kexAlgoDH14SHA1, kexAlgoDH1SHA1,
+}
+
+// PreferredMACs 默认使用的消息摘要算法
+var PreferredMACs = []string{
+	"hmac-sha2-256-etm@openssh.com", "hmac-sha2-256", "hmac-sha1", "hmac-sha1-96",
+}
+
+// SupportedHostKeyAlgos 支持的主机密钥算法
+var SupportedHostKeyAlgos = []string{
+	ssh.CertAlgoRSASHA512v01, ssh.CertAlgoRSASHA256v01,
+	ssh.CertAlgoRSAv01, ssh.CertAlgoDSAv01, ssh.CertAlgoECDSA256v01,
+	ssh.CertAlgoECDSA384v01, ssh.CertAlgoECDSA521v01, ssh.CertAlgoED25519v01,
+
+	ssh.KeyAlgoECDSA256, ssh.KeyAlgoECDSA384, ssh.KeyAlgoECDSA521,
+	ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256,
+	ssh.KeyAlgoRSA, ssh.KeyAlgoDSA,
+
+	ssh.KeyAlgoED25519,
+}
+
+// hostKeyAlgorithms 返回该格式的主机密钥可以使用的签名算法
+func hostKeyAlgorithms(keyFormat string) []string {
+	switch keyFormat {
+	case ssh.KeyAlgoRSA:
+		return []string{ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSA}
+	case ssh.CertAlgoRSAv01:
+		return []string{ssh.CertAlgoRSASHA256v01, ssh.CertAlgoRSASHA512v01, ssh.CertAlgoRSAv01}
+	default:
+		return []string{keyFormat}
+	}
+}
+
+// HardenedCiphers UseHardenedAlgorithms 使用的加密算法，只包含 AEAD 与 CTR 模式的算法
+var HardenedCiphers = []string{
+	"chacha20-poly1305@openssh.com",
+	"aes128-gcm@openssh.com",
+	"aes256-ctr", "aes192-ctr", "aes128-ctr",
+}
+
+// HardenedKexAlgos UseHardenedAlgorithms 使用的密钥交换算法，只包含 curve25519 与 ECDH 算法
+var HardenedKexAlgos = []string{
+	kexAlgoCurve25519SHA256, kexAlgoCurve25519SHA256LibSSH,
+	kexAlgoECDH521, kexAlgoECDH384, kexAlgoECDH256,
+}
+
+// HardenedMACs UseHardenedAlgorithms 使用的消息摘要算法，只包含 ETM（encrypt-then-mac）算法
+var HardenedMACs = []string{
+	"hmac-sha2-256-etm@openssh.com",
+}
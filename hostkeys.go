@@ -0,0 +1,136 @@
+package gosshd
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"golang.org/x/crypto/ssh"
+	"os"
+	"path/filepath"
+)
+
+// OpenSSH 定义的主机密钥更新相关的全局请求，定义于 OpenSSH 的 PROTOCOL 文件 2.5.
+const (
+	GlobalReqHostKeys      = "hostkeys-00@openssh.com"       // 服务端向客户端告知所有的主机公钥
+	GlobalReqHostKeysProve = "hostkeys-prove-00@openssh.com" // 客户端要求服务端证明其拥有对应的主机私钥
+)
+
+// HostKeyFilePattern LoadHostKeysFromDir 加载的主机密钥文件名，与 OpenSSH 的 ssh-keygen -A 生成的文件名相同
+const HostKeyFilePattern = "ssh_host_*_key"
+
+// NoHostKeyErr 没有找到任何主机密钥
+var NoHostKeyErr = errors.New("no host key found")
+
+// LoadHostKeysFromDir 加载 dir 目录下所有文件名匹配 HostKeyFilePattern 的私钥，例如 /etc/ssh 下的 ssh_host_ed25519_key，
+// 公钥文件（.pub）不会被加载，可以在不修改代码的情况下添加新类型的主机密钥；
+// 部分密钥加载失败时，其余的密钥仍被加载，返回记录了所有失败原因的 HostKeyLoadError；没有匹配的文件时返回 NoHostKeyErr
+func (sshd *SSHServer) LoadHostKeysFromDir(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	found := false
+	failures := map[string]error{}
+	for _, entry := range entries {
+		if ok, _ := filepath.Match(HostKeyFilePattern, entry.Name()); !ok || entry.IsDir() {
+			continue
+		}
+		found = true
+		path := filepath.Join(dir, entry.Name())
+		if err := sshd.LoadHostKey(path); err != nil {
+			failures[path] = err
+		}
+	}
+	if !found {
+		return NoHostKeyErr
+	}
+	if len(failures) > 0 {
+		return HostKeyLoadError{Failures: failures}
+	}
+	return nil
+}
+
+// SendHostKeys 向客户端发送 hostkeys-00@openssh.com 全局请求，payload 为所有主机公钥
+func (sshd *SSHServer) SendHostKeys(ctx Context) error {
+	blobs := make([][]byte, 0)
+	for _, signer := range sshd.HostSigners() {
+		blobs = append(blobs, signer.PublicKey().Marshal())
+	}
+	_, _, err := ctx.Conn().SendRequest(GlobalReqHostKeys, false, marshalStrings(blobs))
+	return err
+}
+
+// HandleHostKeysProve 处理 hostkeys-prove-00@openssh.com 全局请求，
+// 使用客户端指定的每个主机密钥，对 "hostkeys-prove-00@openssh.com"、会话标识与公钥组成的数据进行签名，并回复所有签名；
+// 客户端请求的公钥不属于该服务器时，拒绝该请求。
+// 注意：RSA 密钥总是使用 rsa-sha2-512 算法签名
+func (sshd *SSHServer) HandleHostKeysProve(ctx Context, request Request) {
+	blobs, err := parseStrings(request.Payload)
+	if err != nil || len(blobs) == 0 {
+		request.Reply(false, nil)
+		return
+	}
+	signers := map[string]Signer{}
+	for _, signer := range sshd.HostSigners() {
+		signers[string(signer.PublicKey().Marshal())] = signer
+	}
+
+	sigs := make([][]byte, 0, len(blobs))
+	for _, blob := range blobs {
+		signer, ok := signers[string(blob)]
+		if !ok {
+			request.Reply(false, nil)
+			return
+		}
+		data := ssh.Marshal(&struct {
+			Name      string
+			SessionID []byte
+			HostKey   []byte
+		}{GlobalReqHostKeysProve, ctx.Conn().SessionID(), blob})
+
+		var sig *ssh.Signature
+		if algSigner, ok := signer.(ssh.AlgorithmSigner); ok && signer.PublicKey().Type() == ssh.KeyAlgoRSA {
+			sig, err = algSigner.SignWithAlgorithm(rand.Reader, data, ssh.KeyAlgoRSASHA512)
+		} else {
+			sig, err = signer.Sign(rand.Reader, data)
+		}
+		if err != nil {
+			request.Reply(false, nil)
+			return
+		}
+		sigs = append(sigs, ssh.Marshal(sig))
+	}
+	request.Reply(true, marshalStrings(sigs))
+}
+
+// marshalStrings 将多个数据编码为 RFC 4251 5. 中定义的 string 的序列
+func marshalStrings(strs [][]byte) []byte {
+	buf := make([]byte, 0)
+	length := make([]byte, 4)
+	for _, s := range strs {
+		binary.BigEndian.PutUint32(length, uint32(len(s)))
+		buf = append(buf, length...)
+		buf = append(buf, s...)
+	}
+	return buf
+}
+
+// parseStrings 解析 RFC 4251 5. 中定义的 string 的序列
+func parseStrings(data []byte) ([][]byte, error) {
+	strs := make([][]byte, 0)
+	for len(data) > 0 {
+		if len(data) < 4 {
+			return nil, invalidStringsErr
+		}
+		length := binary.BigEndian.Uint32(data)
+		data = data[4:]
+		if uint32(len(data)) < length {
+			return nil, invalidStringsErr
+		}
+		strs = append(strs, data[:length])
+		data = data[length:]
+	}
+	return strs, nil
+}
+
+var invalidStringsErr = errors.New("invalid string sequence")
@@ -0,0 +1,171 @@
+package gosshd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"golang.org/x/crypto/ssh"
+	"net"
+	"sync"
+)
+
+// NegotiatedAlgorithms 握手时双方协商的算法；
+// 加密算法与消息摘要算法两个方向分别协商，使用 AEAD 加密算法（例如 chacha20-poly1305）时对应方向的 MAC 为空
+type NegotiatedAlgorithms struct {
+	Kex                string // 密钥交换算法
+	HostKey            string // 主机密钥算法
+	Cipher             string // 客户端至服务端方向的加密算法
+	MAC                string // 客户端至服务端方向的消息摘要算法
+	CipherServerClient string // 服务端至客户端方向的加密算法
+	MACServerClient    string // 服务端至客户端方向的消息摘要算法
+}
+
+// aeadCiphers 不需要单独 MAC 算法的加密算法
+var aeadCiphers = map[string]bool{
+	"aes128-gcm@openssh.com":        true,
+	"chacha20-poly1305@openssh.com": true,
+}
+
+// kexInitMsg 与 ssh 包中的 SSH_MSG_KEXINIT 消息结构相同，See RFC 4253, section 7.1.
+type kexInitMsg struct {
+	Cookie                  [16]byte `sshtype:"20"`
+	KexAlgos                []string
+	ServerHostKeyAlgos      []string
+	CiphersClientServer     []string
+	CiphersServerClient     []string
+	MACsClientServer        []string
+	MACsServerClient        []string
+	CompressionClientServer []string
+	CompressionServerClient []string
+	LanguagesClientServer   []string
+	LanguagesServerClient   []string
+	FirstKexFollows         bool
+	Reserved                uint32
+}
+
+// 握手阶段允许缓存的最大数据量，超过后放弃解析
+const maxKexInitBuffer = 64 * 1024
+
+// kexInitRecorder ssh 包没有导出协商的算法，所以在握手时记录双方发送的第一个 KEXINIT 消息，
+// 该消息以明文传输，根据 RFC 4253 的规则即可计算出协商的算法
+type kexInitRecorder struct {
+	net.Conn
+	sync.Mutex
+	client kexInitParser // 客户端发送的数据
+	server kexInitParser // 服务端发送的数据
+}
+
+func (r *kexInitRecorder) Read(b []byte) (int, error) {
+	n, err := r.Conn.Read(b)
+	if n > 0 {
+		r.Lock()
+		r.client.feed(b[:n])
+		r.Unlock()
+	}
+	return n, err
+}
+
+func (r *kexInitRecorder) Write(b []byte) (int, error) {
+	r.Lock()
+	r.server.feed(b)
+	r.Unlock()
+	return r.Conn.Write(b)
+}
+
+// Algorithms 返回协商的算法，未能解析双方的 KEXINIT 消息时 ok 为 false
+func (r *kexInitRecorder) Algorithms() (algos NegotiatedAlgorithms, ok bool) {
+	r.Lock()
+	defer r.Unlock()
+	client, server := r.client.msg, r.server.msg
+	if client == nil || server == nil {
+		return algos, false
+	}
+	algos.Kex, ok = findCommon(client.KexAlgos, server.KexAlgos)
+	if !ok {
+		return algos, false
+	}
+	algos.HostKey, _ = findCommon(client.ServerHostKeyAlgos, server.ServerHostKeyAlgos)
+	algos.Cipher, ok = findCommon(client.CiphersClientServer, server.CiphersClientServer)
+	if !ok {
+		return algos, false
+	}
+	if !aeadCiphers[algos.Cipher] {
+		algos.MAC, _ = findCommon(client.MACsClientServer, server.MACsClientServer)
+	}
+	algos.CipherServerClient, ok = findCommon(client.CiphersServerClient, server.CiphersServerClient)
+	if !ok {
+		return algos, false
+	}
+	if !aeadCiphers[algos.CipherServerClient] {
+		algos.MACServerClient, _ = findCommon(client.MACsServerClient, server.MACsServerClient)
+	}
+	return algos, true
+}
+
+// findCommon 返回客户端算法列表中第一个服务端同样支持的算法
+func findCommon(client, server []string) (string, bool) {
+	for _, c := range client {
+		for _, s := range server {
+			if c == s {
+				return c, true
+			}
+		}
+	}
+	return "", false
+}
+
+// kexInitParser 从一个方向的数据流中解析版本号之后的第一个数据包，即 KEXINIT 消息
+type kexInitParser struct {
+	buf         []byte
+	versionRead bool
+	done        bool
+	msg         *kexInitMsg
+}
+
+func (p *kexInitParser) feed(b []byte) {
+	if p.done {
+		return
+	}
+	p.buf = append(p.buf, b...)
+	if len(p.buf) > maxKexInitBuffer {
+		p.finish(nil)
+		return
+	}
+	// 版本号之前可能存在其它文本行，See RFC 4253, section 4.2.
+	for !p.versionRead {
+		i := bytes.IndexByte(p.buf, '\n')
+		if i < 0 {
+			return
+		}
+		line := p.buf[:i+1]
+		p.buf = p.buf[i+1:]
+		p.versionRead = bytes.HasPrefix(line, []byte("SSH-"))
+	}
+	if len(p.buf) < 5 {
+		return
+	}
+	length := binary.BigEndian.Uint32(p.buf)
+	if length > maxKexInitBuffer {
+		p.finish(nil)
+		return
+	}
+	if uint32(len(p.buf)-4) < length {
+		return
+	}
+	padding := uint32(p.buf[4])
+	if padding+1 > length {
+		p.finish(nil)
+		return
+	}
+	msg := &kexInitMsg{}
+	if err := ssh.Unmarshal(p.buf[5:4+length-padding], msg); err != nil {
+		p.finish(nil)
+		return
+	}
+	p.finish(msg)
+}
+
+func (p *kexInitParser) finish(msg *kexInitMsg) {
+	p.msg = msg
+	p.done = true
+	p.buf = nil
+}
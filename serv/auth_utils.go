@@ -1,14 +1,13 @@
 package serv
 
 import (
-	"bytes"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
 	"github.com/nishoushun/gosshd"
 	"golang.org/x/crypto/ssh"
 	"io/ioutil"
-	"os/user"
-	"path"
 	"runtime"
 )
 
@@ -31,13 +30,9 @@ func CheckUnixPasswd(conn gosshd.ConnMetadata, password []byte) (*gosshd.Permiss
 	return &gosshd.Permissions{CriticalOptions: map[string]string{}, Extensions: map[string]string{PassedPasswdKey: string(password)}}, nil
 }
 
-// CheckPublicKeyByAuthorizedKeys 检查客户端发送的公钥是否在 `authorized_keys` 中
+// CheckPublicKeyByAuthorizedKeys 检查客户端发送的公钥是否在 `authorized_keys` 中，公钥由 DefaultAuthorizedKeysProvider 提供
 func CheckPublicKeyByAuthorizedKeys(conn gosshd.ConnMetadata, key gosshd.PublicKey) (*gosshd.Permissions, error) {
-	userInfo, err := user.Lookup(conn.User())
-	if err != nil {
-		return nil, gosshd.UserNotExistError{User: conn.User()}
-	}
-	return LoadAndCheck(path.Join(userInfo.HomeDir, AuthorizedKeysPath), key)
+	return CheckPublicKeyByProvider(DefaultAuthorizedKeysProvider)(conn, key)
 }
 
 // LoadAndCheck 加载并解析文件，并检查 key 是否被包含。
@@ -47,25 +42,22 @@ func LoadAndCheck(path string, key gosshd.PublicKey) (*gosshd.Permissions, error
 	if err != nil {
 		return nil, err
 	}
-	keys := map[string]struct{}{}
-	for len(authorizedKeysBytes) > 0 {
-		pubKey, _, _, rest, err := ssh.ParseAuthorizedKey(authorizedKeysBytes)
-		if err != nil {
-			continue
+	marshaled := string(key.Marshal())
+	for _, entry := range parseAuthorizedKeys(authorizedKeysBytes) {
+		if string(entry.key.Marshal()) == marshaled {
+			return authorizedKeyPermissions(key, entry.options), nil
 		}
-		keys[string(pubKey.Marshal())] = struct{}{}
-		authorizedKeysBytes = rest
-	}
-	if _, ok := keys[string(key.Marshal())]; ok {
-		return &gosshd.Permissions{CriticalOptions: map[string]string{}, Extensions: map[string]string{PassedPublicKey: string(key.Marshal())}}, nil
 	}
 	return nil, gosshd.PermitNotAllowedError{Msg: "no authorized key found"}
 }
 
-// FixedPasswdCallback 固定服务器密码验证回调函数
+// FixedPasswdCallback 固定服务器密码验证回调函数；
+// 比较的是两者的 SHA-256 摘要，且使用常量时间比较，避免通过响应时间泄露密码长度与内容
 func FixedPasswdCallback(passwd []byte) gosshd.PasswdCallback {
+	expected := sha256.Sum256(passwd)
 	return func(conn gosshd.ConnMetadata, password []byte) (*gosshd.Permissions, error) {
-		if bytes.Compare(password, passwd) != 0 {
+		actual := sha256.Sum256(password)
+		if subtle.ConstantTimeCompare(actual[:], expected[:]) != 1 {
 			return nil, &gosshd.PermitNotAllowedError{Msg: "wrong password"}
 		}
 		return &gosshd.Permissions{CriticalOptions: map[string]string{}, Extensions: map[string]string{PassedPasswdKey: string(password)}}, nil
@@ -0,0 +1,222 @@
+package serv
+
+import (
+	"github.com/nishoushun/gosshd"
+	"golang.org/x/crypto/ssh"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AuthorizedKeysProvider 提供用户被授权的公钥，可由文件、LDAP、数据库等实现，
+// 类似于 OpenSSH 的 AuthorizedKeysFile 与 AuthorizedKeysCommand
+type AuthorizedKeysProvider interface {
+	KeysFor(user string) ([]gosshd.PublicKey, error)
+}
+
+// AuthorizedKeyOptionsProvider 可由 AuthorizedKeysProvider 选择实现，提供公钥在 authorized_keys 中对应的选项，
+// 例如 permitopen="host:port"；选项会被添加到身份认证返回的 Permissions 中
+type AuthorizedKeyOptionsProvider interface {
+	OptionsFor(user string, key gosshd.PublicKey) ([]string, error)
+}
+
+// authorized_keys 中支持的选项
+const (
+	PermitOpenOption  = "permitopen"  // 限制 direct-tcpip 可以连接的目标，多个值以 ',' 分隔
+	EnvironmentOption = "environment" // session 的环境变量，形式为 NAME=value，多个值以 '\n' 分隔
+)
+
+// DefaultAuthorizedKeysProvider CheckPublicKeyByAuthorizedKeys 使用的公钥来源，读取用户主目录下的 authorized_keys 文件
+var DefaultAuthorizedKeysProvider = NewAuthorizedKeysFileProvider()
+
+// AuthorizedKeysFileProvider 从 authorized_keys 文件中读取公钥，
+// 解析结果会被缓存，仅当文件的修改时间或大小改变时才会重新读取
+type AuthorizedKeysFileProvider struct {
+	sync.Mutex
+	// 获取用户的 authorized_keys 文件路径，默认为用户主目录下的 .ssh/authorized_keys
+	PathFunc func(username string) (string, error)
+
+	cache map[string]*authorizedKeysEntry // 文件路径与解析结果的映射
+}
+
+type authorizedKeysEntry struct {
+	modTime time.Time
+	size    int64
+	keys    []authorizedKey
+}
+
+// authorizedKey authorized_keys 中的一条记录
+type authorizedKey struct {
+	key     gosshd.PublicKey
+	options []string
+}
+
+// NewAuthorizedKeysFileProvider 创建一个读取用户主目录下 authorized_keys 文件的 AuthorizedKeysFileProvider
+func NewAuthorizedKeysFileProvider() *AuthorizedKeysFileProvider {
+	return &AuthorizedKeysFileProvider{
+		PathFunc: UserAuthorizedKeysPath,
+		cache:    map[string]*authorizedKeysEntry{},
+	}
+}
+
+// UserAuthorizedKeysPath 返回用户主目录下的 authorized_keys 文件路径
+func UserAuthorizedKeysPath(username string) (string, error) {
+	userInfo, err := user.Lookup(username)
+	if err != nil {
+		return "", gosshd.UserNotExistError{User: username}
+	}
+	return path.Join(userInfo.HomeDir, AuthorizedKeysPath), nil
+}
+
+// KeysFor 返回用户 authorized_keys 文件中的所有公钥
+func (p *AuthorizedKeysFileProvider) KeysFor(username string) ([]gosshd.PublicKey, error) {
+	entries, err := p.load(username)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]gosshd.PublicKey, 0, len(entries))
+	for _, entry := range entries {
+		keys = append(keys, entry.key)
+	}
+	return keys, nil
+}
+
+// OptionsFor 返回公钥在用户 authorized_keys 文件中对应的选项
+func (p *AuthorizedKeysFileProvider) OptionsFor(username string, key gosshd.PublicKey) ([]string, error) {
+	entries, err := p.load(username)
+	if err != nil {
+		return nil, err
+	}
+	marshaled := string(key.Marshal())
+	for _, entry := range entries {
+		if string(entry.key.Marshal()) == marshaled {
+			return entry.options, nil
+		}
+	}
+	return nil, nil
+}
+
+// load 读取并解析用户的 authorized_keys 文件，文件未改变时使用缓存
+func (p *AuthorizedKeysFileProvider) load(username string) ([]authorizedKey, error) {
+	pathFunc := p.PathFunc
+	if pathFunc == nil {
+		pathFunc = UserAuthorizedKeysPath
+	}
+	keysPath, err := pathFunc(username)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(keysPath)
+	if err != nil {
+		p.Lock()
+		delete(p.cache, keysPath)
+		p.Unlock()
+		return nil, err
+	}
+
+	p.Lock()
+	entry, ok := p.cache[keysPath]
+	p.Unlock()
+	if ok && entry.modTime.Equal(info.ModTime()) && entry.size == info.Size() {
+		return entry.keys, nil
+	}
+
+	content, err := ioutil.ReadFile(keysPath)
+	if err != nil {
+		return nil, err
+	}
+	entry = &authorizedKeysEntry{
+		modTime: info.ModTime(),
+		size:    info.Size(),
+		keys:    parseAuthorizedKeys(content),
+	}
+	p.Lock()
+	if p.cache == nil {
+		p.cache = map[string]*authorizedKeysEntry{}
+	}
+	p.cache[keysPath] = entry
+	p.Unlock()
+	return entry.keys, nil
+}
+
+// CheckPublicKeyByProvider 返回一个 PublicKeyCallback，检查客户端发送的公钥是否由 provider 提供；
+// 如果被包含，则在返回的 Permission 的 Extension 字段中添加 "passed-public-key" 以及对应的公钥内容
+func CheckPublicKeyByProvider(provider AuthorizedKeysProvider) gosshd.PublicKeyCallback {
+	return func(conn gosshd.ConnMetadata, key gosshd.PublicKey) (*gosshd.Permissions, error) {
+		keys, err := provider.KeysFor(conn.User())
+		if err != nil {
+			return nil, err
+		}
+		marshaled := string(key.Marshal())
+		for _, k := range keys {
+			if string(k.Marshal()) == marshaled {
+				var options []string
+				if optionsProvider, ok := provider.(AuthorizedKeyOptionsProvider); ok {
+					if options, err = optionsProvider.OptionsFor(conn.User(), key); err != nil {
+						return nil, err
+					}
+				}
+				return authorizedKeyPermissions(key, options), nil
+			}
+		}
+		return nil, gosshd.PermitNotAllowedError{Msg: "no authorized key found"}
+	}
+}
+
+// authorizedKeyPermissions 生成通过公钥认证后的 Permissions，
+// Extensions 中包含 "passed-public-key" 以及对应的公钥内容，CriticalOptions 中包含支持的 authorized_keys 选项
+func authorizedKeyPermissions(key gosshd.PublicKey, options []string) *gosshd.Permissions {
+	perms := &gosshd.Permissions{CriticalOptions: map[string]string{}, Extensions: map[string]string{PassedPublicKey: string(key.Marshal())}}
+	for _, option := range options {
+		name, value := option, ""
+		if i := strings.Index(option, "="); i >= 0 {
+			name, value = option[:i], strings.Trim(option[i+1:], "\"")
+		}
+		switch strings.ToLower(name) {
+		case PermitOpenOption:
+			if old, ok := perms.CriticalOptions[PermitOpenOption]; ok {
+				value = old + "," + value
+			}
+			perms.CriticalOptions[PermitOpenOption] = value
+		case EnvironmentOption:
+			if !strings.Contains(value, "=") {
+				continue
+			}
+			if old, ok := perms.CriticalOptions[EnvironmentOption]; ok {
+				value = old + "\n" + value
+			}
+			perms.CriticalOptions[EnvironmentOption] = value
+		}
+	}
+	return perms
+}
+
+// UserEnvironment 返回身份认证时 authorized_keys 中 environment 选项设置的环境变量，形式为 NAME=value
+func UserEnvironment(perms *gosshd.Permissions) []string {
+	if perms == nil || perms.CriticalOptions == nil {
+		return nil
+	}
+	environment, ok := perms.CriticalOptions[EnvironmentOption]
+	if !ok || environment == "" {
+		return nil
+	}
+	return strings.Split(environment, "\n")
+}
+
+// parseAuthorizedKeys 解析 authorized_keys 文件内容，忽略无法解析的行
+func parseAuthorizedKeys(content []byte) []authorizedKey {
+	keys := make([]authorizedKey, 0)
+	for len(content) > 0 {
+		pubKey, _, options, rest, err := ssh.ParseAuthorizedKey(content)
+		if err != nil { // 剩余内容中已经没有合法的公钥
+			break
+		}
+		keys = append(keys, authorizedKey{key: pubKey, options: options})
+		content = rest
+	}
+	return keys
+}
@@ -0,0 +1,94 @@
+package serv
+
+import (
+	"github.com/nishoushun/gosshd"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+)
+
+// Motd unix 系统下的登陆提示信息文件
+const Motd = "/etc/motd"
+
+// MOTDBanner 返回一个 BannerCallback，每次建立连接时读取 path 文件的内容作为身份认证之前的提示信息，
+// 文件内容中的转义序列与 TemplatedBanner 相同；文件不存在时不发送提示信息。例如：
+//
+//	sshd.SetBannerCallback(serv.MOTDBanner("/etc/issue.net"))
+func MOTDBanner(path string) gosshd.BannerCallback {
+	return func(metadata gosshd.ConnMetadata) string {
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return ""
+		}
+		return expandBanner(string(content), metadata)
+	}
+}
+
+// TemplatedBanner 返回一个 BannerCallback，将 tmpl 作为身份认证之前的提示信息，例如法律声明，其中的转义序列将被替换：
+// %u 为客户端声明的用户名（尚未通过身份认证），%a 为客户端的 IP 地址，%D 为当前日期（例如 2022-06-01），%% 为 %。例如：
+//
+//	sshd.SetBannerCallback(serv.TemplatedBanner("Connections from %a are logged.\n"))
+func TemplatedBanner(tmpl string) gosshd.BannerCallback {
+	return func(metadata gosshd.ConnMetadata) string {
+		return expandBanner(tmpl, metadata)
+	}
+}
+
+// expandBanner 替换提示信息模板中的转义序列，未知的转义序列保持不变
+func expandBanner(tmpl string, metadata gosshd.ConnMetadata) string {
+	if !strings.Contains(tmpl, "%") {
+		return tmpl
+	}
+	var builder strings.Builder
+	for i := 0; i < len(tmpl); i++ {
+		if tmpl[i] != '%' || i+1 == len(tmpl) {
+			builder.WriteByte(tmpl[i])
+			continue
+		}
+		i++
+		switch tmpl[i] {
+		case 'u':
+			builder.WriteString(metadata.User())
+		case 'a':
+			builder.WriteString(remoteHost(metadata.RemoteAddr()))
+		case 'D':
+			builder.WriteString(time.Now().Format("2006-01-02"))
+		case '%':
+			builder.WriteByte('%')
+		default:
+			builder.WriteByte('%')
+			builder.WriteByte(tmpl[i])
+		}
+	}
+	return builder.String()
+}
+
+// remoteHost 返回地址中的主机部分，不包含端口
+func remoteHost(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// MOTDFromFile 返回一个可作为 DefaultSessionChanHandler 的 MOTD 的函数，每次读取 path 文件的内容，
+// 文件内容中的转义序列与 TemplatedBanner 相同；文件不存在时不发送提示信息
+func MOTDFromFile(path string) func(ctx gosshd.Context) string {
+	return func(ctx gosshd.Context) string {
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return ""
+		}
+		return expandBanner(string(content), ctx.Conn())
+	}
+}
+
+// toCRLF 将换行符转换为 "\r\n"，pty 处于 raw 模式的客户端终端需要 "\r" 才能回到行首
+func toCRLF(s string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(s, "\r\n", "\n"), "\n", "\r\n")
+}
@@ -1,9 +1,12 @@
 package serv
 
 import (
+	"errors"
 	"fmt"
 	"github.com/nishoushun/gosshd"
+	"os"
 	"os/exec"
+	"os/user"
 	"runtime"
 	"strconv"
 	"syscall"
@@ -26,30 +29,78 @@ import (
 //	MACs:                    nil,
 //}
 
-func LookupUserInfo(user string) (*gosshd.User, error) {
+// LookupUserInfo 查找用户信息，Linux 系统下使用 UnixUserInfo，其他系统使用 os/user 包查找
+func LookupUserInfo(username string) (*gosshd.User, error) {
 	switch runtime.GOOS {
 	case "linux":
-		return UnixUserInfo(user)
+		return UnixUserInfo(username)
 	default:
-		return nil, gosshd.PlatformNotSupportError{Function: "user info"}
+		u, err := user.Lookup(username)
+		if err != nil {
+			var unknown user.UnknownUserError
+			if errors.As(err, &unknown) {
+				return nil, gosshd.UserNotExistError{User: username}
+			}
+			return nil, err
+		}
+		return gosshd.UserFromOSUser(u)
 	}
 }
 
-// CreateCmdWithUser 指定用户身份创建子进程
-func CreateCmdWithUser(user *gosshd.User, cmdline string, args ...string) (*exec.Cmd, error) {
-	if user == nil || cmdline == "" {
+// CreateCmdWithUser 指定用户身份创建子进程；
+// Uid、Gid 可以是数字或者用户名、组名，Gid 为空时使用该用户的主组；
+// Uid 为空或者与服务器进程的 uid 相同时不切换身份，以服务器进程自身的身份运行，非 root 用户切换身份会失败
+func CreateCmdWithUser(u *gosshd.User, cmdline string, args ...string) (*exec.Cmd, error) {
+	if u == nil || cmdline == "" {
 		return nil, fmt.Errorf("illegal args")
 	}
 	cmd := exec.Command(cmdline, args...)
-	uid, err := strconv.Atoi(user.Uid)
+	if u.Uid == "" {
+		return cmd, nil
+	}
+	uid, err := resolveUid(u.Uid)
 	if err != nil {
-		return nil, fmt.Errorf("wrong uid: '%s'", user.Uid)
+		return nil, err
+	}
+	if uid == os.Getuid() {
+		return cmd, nil
 	}
-	gid, err := strconv.Atoi(user.Gid)
+	gid, err := resolveGid(u.Gid, uid)
 	if err != nil {
-		return nil, fmt.Errorf("wrong gid: '%s'", user.Gid)
+		return nil, err
 	}
 	cmd.SysProcAttr = &syscall.SysProcAttr{}
 	cmd.SysProcAttr.Credential = &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}
 	return cmd, nil
 }
+
+// resolveUid 将数字或者用户名形式的 uid 转换为数字
+func resolveUid(uid string) (int, error) {
+	if id, err := strconv.Atoi(uid); err == nil {
+		return id, nil
+	}
+	u, err := user.Lookup(uid)
+	if err != nil {
+		return 0, fmt.Errorf("wrong uid: '%s'", uid)
+	}
+	return strconv.Atoi(u.Uid)
+}
+
+// resolveGid 将数字或者组名形式的 gid 转换为数字，gid 为空时使用 uid 对应用户的主组
+func resolveGid(gid string, uid int) (int, error) {
+	if gid == "" {
+		u, err := user.LookupId(strconv.Itoa(uid))
+		if err != nil {
+			return 0, fmt.Errorf("no primary group for uid: %d", uid)
+		}
+		gid = u.Gid
+	}
+	if id, err := strconv.Atoi(gid); err == nil {
+		return id, nil
+	}
+	g, err := user.LookupGroup(gid)
+	if err != nil {
+		return 0, fmt.Errorf("wrong gid: '%s'", gid)
+	}
+	return strconv.Atoi(g.Gid)
+}
@@ -5,7 +5,8 @@ import (
 	"github.com/nishoushun/gosshd"
 	"golang.org/x/crypto/ssh"
 	"net"
-	"sync"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -20,71 +21,105 @@ func NewTcpIpDirector(timeout time.Duration) *TcpIpDirector {
 // 之后将数据转发至 remote-addr:remote-port
 type TcpIpDirector struct {
 	timeout time.Duration
+
+	// 用于连接目标网络，可用于通过代理、连接池等方式转发；为 nil 时使用 net.Dialer 的 DialContext
+	Dialer func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// 转发时每个方向的复制缓冲区大小，为 0 时使用 DefaultCopyBufferSize
+	BufSize int
+
+	// 每个 channel 每个方向每秒转发的最大字节数，为 0 时不限速
+	RateLimit int
+}
+
+// dial 使用 Dialer 连接目标网络，未设置 Dialer 时使用超时时间为 d 的 timeout 属性的 net.Dialer；
+// ctx 被取消时（例如客户端断开连接或服务器关闭），正在进行的连接将被中止
+func (d *TcpIpDirector) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	if d.Dialer != nil {
+		return d.Dialer(ctx, network, addr)
+	}
+	dialer := &net.Dialer{Timeout: d.timeout}
+	return dialer.DialContext(ctx, network, addr)
 }
 
 // HandleDirectTcpIP 开始处理一个 direct-tcpip 类型的信道，连接客户端发送的目标网络，并连接双方。
-// net.DialTimeout 将会被调用，timeout 为 d 的 timeout 属性；
+// 目标网络由 d 的 Dialer 进行连接；
 func (d *TcpIpDirector) HandleDirectTcpIP(ctx gosshd.Context, newChannel gosshd.NewChannel) {
 	if newChannel.ChannelType() != gosshd.DirectTcpIpChannel {
 		return
 	}
 	c, cancel := context.WithCancel(ctx)
+	defer cancel()
 	metadata := &gosshd.ChannelOpenDirectMsg{}
 	if err := ssh.Unmarshal(newChannel.ExtraData(), metadata); err != nil {
 		newChannel.Reject(ssh.Prohibited, "invalid tcp-ip metadata")
 		return
 	}
-
-	// 从 sshd 实例中找到对应 ChannelHandler
-	channel, requests, err := newChannel.Accept()
-	if err != nil {
+	if !PermitOpen(ctx.Permissions(), metadata.Dest, metadata.DPort) {
+		newChannel.Reject(ssh.Prohibited, "administratively prohibited open failed")
 		return
 	}
 
-	//fmt.Println("meta", metadata)
+	// 目标地址可能是域名或者带有 zone 的 IPv6 链路本地地址（例如 fe80::1%eth0），由 Dialer 负责解析
+	dst := net.JoinHostPort(strings.Trim(metadata.Dest, "[]"), strconv.Itoa(int(metadata.DPort)))
 
-	//src := &net.TCPAddr{
-	//	IP:   net.ParseIP(metadata.Src),
-	//	Port: 48494,
-	//	Zone: "",
-	//}
-
-	dst := &net.TCPAddr{
-		IP:   net.ParseIP(metadata.Dest),
-		Port: int(metadata.DPort),
-		Zone: "",
+	// 先连接目标网络，连接失败时拒绝通道建立请求，客户端可以根据拒绝原因给出提示
+	conn, err := d.dial(c, "tcp", dst)
+	if err != nil {
+		newChannel.Reject(gosshd.ConnectionFailed, err.Error())
+		return
 	}
-	//fmt.Println("dst", dst.String())
 
-	//var conn net.Conn
-	//conn, err = net.DialTCP("tcp", src, dst)
-	//fmt.Println(err)
-	//if err != nil {
-	conn, err := net.DialTimeout("tcp", dst.String(), d.timeout)
+	channel, requests, err := newChannel.Accept()
 	if err != nil {
+		conn.Close()
 		return
 	}
-	//fmt.Println("conn")
-	//}
-	var wg sync.WaitGroup
-	wg.Add(2)
-
-	go gosshd.DiscardRequests(requests, ctx)
 
-	go func() {
-		CopyBufferWithContext(channel, conn, nil, c)
-		defer conn.Close()
-		defer channel.Close()
-		wg.Done()
+	go gosshd.DiscardRequests(ctx, requests)
+	var rbuf, wbuf []byte
+	if d.BufSize > 0 {
+		rbuf = make([]byte, d.BufSize)
+		wbuf = make([]byte, d.BufSize)
+	}
+	RelayWithContext(c, NewRateLimitedChannel(channel, d.RateLimit), conn, rbuf, wbuf)
+}
 
-	}()
+// PermitOpen 根据身份认证返回的 Permissions 中的 permitopen 选项，判断是否允许连接目标地址；
+// permitopen 的形式为以 ',' 分隔的 host:port 列表，host 与 port 均可为 '*'；未设置该选项时允许连接任意地址
+func PermitOpen(perms *gosshd.Permissions, host string, port uint32) bool {
+	if perms == nil || perms.CriticalOptions == nil {
+		return true
+	}
+	permitOpen, ok := perms.CriticalOptions[PermitOpenOption]
+	if !ok {
+		return true
+	}
+	for _, target := range strings.Split(permitOpen, ",") {
+		permitHost, permitPort, err := net.SplitHostPort(strings.TrimSpace(target))
+		if err != nil {
+			continue
+		}
+		if permitHost != "*" && !strings.EqualFold(permitHost, host) {
+			continue
+		}
+		if permitPort == "*" || permitPort == strconv.Itoa(int(port)) {
+			return true
+		}
+	}
+	return false
+}
 
-	go func() {
-		CopyBufferWithContext(conn, channel, nil, c)
-		conn.Close()
-		channel.Close()
-		wg.Done()
-	}()
-	wg.Wait()
-	cancel()
+// parseIPZone 解析可能带有 IPv6 zone 的地址，例如 fe80::1%eth0；host 不是 IP 地址时返回的 IP 为 nil
+func parseIPZone(host string) (net.IP, string) {
+	host = strings.Trim(host, "[]")
+	zone := ""
+	if i := strings.LastIndexByte(host, '%'); i > 0 {
+		host, zone = host[:i], host[i+1:]
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, ""
+	}
+	return ip, zone
 }
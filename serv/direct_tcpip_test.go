@@ -0,0 +1,71 @@
+package serv
+
+import (
+	"context"
+	"errors"
+	"github.com/nishoushun/gosshd"
+	"github.com/nishoushun/gosshd/serv/testutil"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestTcpIpDirectorDialer(t *testing.T) {
+	targets := make(chan string, 1)
+	director := NewTcpIpDirector(0)
+	director.Dialer = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		targets <- network + " " + addr
+		server, client := net.Pipe()
+		go func() {
+			defer server.Close()
+			io.Copy(server, server)
+		}()
+		return client, nil
+	}
+	_, dial := testutil.NewTestServer(func(sshd *gosshd.SSHServer) {
+		sshd.SetNewChanHandleFunc(gosshd.DirectTcpIpChannel, director.HandleDirectTcpIP)
+	})
+	client := dial()
+	defer client.Close()
+
+	conn, err := client.Dial("tcp", "192.0.2.1:8080")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if target := <-targets; target != "tcp 192.0.2.1:8080" {
+		t.Fatalf("dial target = %q, want %q", target, "tcp 192.0.2.1:8080")
+	}
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "ping" {
+		t.Fatalf("relayed %q, want %q", buf, "ping")
+	}
+}
+
+func TestTcpIpDirectorDialFailure(t *testing.T) {
+	director := NewTcpIpDirector(0)
+	director.Dialer = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return nil, errors.New("connection refused")
+	}
+	_, dial := testutil.NewTestServer(func(sshd *gosshd.SSHServer) {
+		sshd.SetNewChanHandleFunc(gosshd.DirectTcpIpChannel, director.HandleDirectTcpIP)
+	})
+	client := dial()
+	defer client.Close()
+
+	_, err := client.Dial("tcp", "192.0.2.1:8080")
+	var openErr *ssh.OpenChannelError
+	if !errors.As(err, &openErr) {
+		t.Fatalf("err = %v, want *ssh.OpenChannelError", err)
+	}
+	if openErr.Reason != gosshd.ConnectionFailed || openErr.Message != "connection refused" {
+		t.Fatalf("rejected with %d %q, want %d %q", openErr.Reason, openErr.Message, gosshd.ConnectionFailed, "connection refused")
+	}
+}
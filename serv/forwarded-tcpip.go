@@ -1,24 +1,47 @@
 package serv
 
 import (
+	"context"
 	"github.com/nishoushun/gosshd"
 	"golang.org/x/crypto/ssh"
 	"net"
 	"strconv"
+	"strings"
 	"sync"
 )
 
 // ForwardedTcpIpRequestHandler 用于处理 tcpip-forward 全局请求
 type ForwardedTcpIpRequestHandler struct {
 	bufSize  int
-	forwards map[string]net.Listener
+	maxConns int
+	forwards map[string]*forward
 	sync.Mutex
+
+	// 类似于 sshd_config 的 GatewayPorts 选项，为 false 时只监听回环地址，
+	// 客户端请求的非回环地址（包括空地址与 0.0.0.0）将被改写为 127.0.0.1
+	GatewayPorts bool
+
+	// 每个 forwarded-tcpip 通道每个方向每秒转发的最大字节数，为 0 时不限速
+	RateLimit int
 }
 
-func NewForwardedTcpIpHandler(bufSize int) *ForwardedTcpIpRequestHandler {
+// forward 单个 tcpip-forward 请求对应的监听器，cancel 用于关闭该转发建立的所有连接
+type forward struct {
+	net.Listener
+	cancel context.CancelFunc
+}
+
+// DefaultMaxForwardedConns SimpleServerOnUnix 中每个 tcpip-forward 允许同时存在的 forwarded-tcpip 通道数
+const DefaultMaxForwardedConns = 128
+
+// NewForwardedTcpIpHandler 创建一个 ForwardedTcpIpRequestHandler；
+// bufSize 为转发时每个方向的复制缓冲区大小，为 0 时使用 DefaultCopyBufferSize；
+// maxConns 为每个 tcpip-forward 允许同时存在的 forwarded-tcpip 通道数，超出时新的连接将被直接关闭，为 0 时不限制
+func NewForwardedTcpIpHandler(bufSize, maxConns int) *ForwardedTcpIpRequestHandler {
 	return &ForwardedTcpIpRequestHandler{
 		bufSize:  bufSize,
-		forwards: map[string]net.Listener{},
+		maxConns: maxConns,
+		forwards: map[string]*forward{},
 		Mutex:    sync.Mutex{},
 	}
 }
@@ -43,8 +66,8 @@ func (h *ForwardedTcpIpRequestHandler) ServeForward(ctx gosshd.Context, request
 		request.Reply(false, invalidPayload)
 		return
 	}
-	addr := net.JoinHostPort(forwardReq.BindAddr, strconv.Itoa(int(forwardReq.BindPort)))
-	ln, err := net.Listen("tcp", addr)
+	bindAddr := net.JoinHostPort(h.listenHost(forwardReq.BindAddr), strconv.Itoa(int(forwardReq.BindPort)))
+	ln, err := net.Listen("tcp", bindAddr)
 	if err != nil {
 		request.Reply(false, []byte(err.Error()))
 		return
@@ -53,28 +76,51 @@ func (h *ForwardedTcpIpRequestHandler) ServeForward(ctx gosshd.Context, request
 	_, destPortStr, err := net.SplitHostPort(ln.Addr().String())
 	destPort, err := strconv.Atoi(destPortStr)
 	if err != nil {
+		ln.Close()
 		request.Reply(false, nil)
 		return
 	}
 
-	request.Reply(true, nil)
+	// 客户端取消转发时，使用其请求的地址以及实际监听的端口
+	addr := net.JoinHostPort(forwardReq.BindAddr, destPortStr)
+
+	// 根据 RFC 4254 7.1. 当请求的端口为 0 时，需要回复实际监听的端口
+	if forwardReq.BindPort == 0 {
+		request.Reply(true, ssh.Marshal(&gosshd.RemoteForwardSuccessMsg{BindPort: uint32(destPort)}))
+	} else {
+		request.Reply(true, nil)
+	}
 
+	// 每个转发拥有独立的 context，取消转发时关闭由其建立的所有连接
+	fctx, cancel := context.WithCancel(ctx)
 	h.Lock()
-	h.forwards[addr] = ln
+	h.forwards[addr] = &forward{Listener: ln, cancel: cancel}
 	h.Unlock()
 
 	go func() {
-		select {
-		case <-ctx.Done():
-			h.CloseAndDel(addr)
-		}
+		<-fctx.Done()
+		h.CloseAndDel(addr)
 	}()
 
+	// 限制该转发同时存在的通道数，防止大量连接耗尽服务器资源
+	var sem chan struct{}
+	if h.maxConns > 0 {
+		sem = make(chan struct{}, h.maxConns)
+	}
+
 	for {
 		remoteConn, err := ln.Accept()
 		if err != nil {
 			break
 		}
+		if sem != nil {
+			select {
+			case sem <- struct{}{}:
+			default:
+				remoteConn.Close()
+				continue
+			}
+		}
 		originAddr, orignPortStr, _ := net.SplitHostPort(ctx.RemoteAddr().String())
 		originPort, _ := strconv.Atoi(orignPortStr)
 		remoteForwardChannelDataMsg := ssh.Marshal(&gosshd.RemoteForwardChannelDataMsg{
@@ -86,37 +132,53 @@ func (h *ForwardedTcpIpRequestHandler) ServeForward(ctx gosshd.Context, request
 
 		// 每监听到一个网络连接，就向客户端打开一个通道，然后转发数据
 		go func() {
-			channel, requests, err := ctx.Conn().OpenChannel(gosshd.ForwardedTcpIpChannelType, remoteForwardChannelDataMsg)
-			if err != nil {
-				request.Reply(false, []byte(err.Error()))
-				remoteConn.Close()
-				return
+			h.forwardConn(ctx, fctx, remoteConn, remoteForwardChannelDataMsg)
+			if sem != nil {
+				<-sem
 			}
+		}()
+	}
+	cancel()
+}
+
+// listenHost 根据 GatewayPorts 选项，返回实际监听的主机地址；IPv6 地址去除方括号并保留 zone，例如 fe80::1%eth0
+func (h *ForwardedTcpIpRequestHandler) listenHost(host string) string {
+	host = strings.Trim(host, "[]")
+	if h.GatewayPorts {
+		if host == "*" {
+			return ""
+		}
+		return host
+	}
+	if host == "localhost" {
+		return host
+	}
+	if ip, _ := parseIPZone(host); ip != nil && ip.IsLoopback() {
+		return host
+	}
+	return "127.0.0.1"
+}
 
-			go ssh.DiscardRequests(requests)
+// forwardConn 向客户端打开一个 forwarded-tcpip 通道，并在通道与 remoteConn 之间转发数据；
+// 当转发对应的 fctx 被取消时，关闭该通道与连接；转发结束后返回
+func (h *ForwardedTcpIpRequestHandler) forwardConn(ctx gosshd.Context, fctx context.Context, remoteConn net.Conn, channelData []byte) {
+	channel, requests, err := ctx.Conn().OpenChannel(gosshd.ForwardedTcpIpChannelType, channelData)
+	if err != nil {
+		remoteConn.Close()
+		return
+	}
 
-			var wbuf []byte = nil
-			var rbuf []byte = nil
+	go gosshd.DiscardRequests(ctx, requests)
 
-			if h.bufSize > 0 {
-				wbuf = make([]byte, h.bufSize)
-				rbuf = make([]byte, h.bufSize)
-			}
+	var wbuf []byte = nil
+	var rbuf []byte = nil
 
-			go func() {
-				defer channel.Close()
-				defer remoteConn.Close()
-				CopyBufferWithContext(channel, remoteConn, rbuf, ctx)
-			}()
-
-			go func() {
-				defer channel.Close()
-				defer remoteConn.Close()
-				CopyBufferWithContext(remoteConn, channel, wbuf, ctx)
-			}()
-		}()
+	if h.bufSize > 0 {
+		wbuf = make([]byte, h.bufSize)
+		rbuf = make([]byte, h.bufSize)
 	}
-	h.CloseAndDel(addr)
+
+	RelayWithContext(fctx, NewRateLimitedChannel(channel, h.RateLimit), remoteConn, rbuf, wbuf)
 }
 
 func (h *ForwardedTcpIpRequestHandler) CancelForward(ctx gosshd.Context, request gosshd.Request) {
@@ -130,13 +192,14 @@ func (h *ForwardedTcpIpRequestHandler) CancelForward(ctx gosshd.Context, request
 	request.Reply(true, nil)
 }
 
-// CloseAndDel 删除并关闭对应地址的 listener
+// CloseAndDel 删除并关闭对应地址的 listener，并关闭该转发建立的所有连接
 func (h *ForwardedTcpIpRequestHandler) CloseAndDel(addr string) {
 	h.Lock()
 	defer h.Unlock()
-	ln, ok := h.forwards[addr]
+	f, ok := h.forwards[addr]
 	if ok {
-		ln.Close()
+		f.cancel()
+		f.Close()
 		delete(h.forwards, addr)
 	}
 }
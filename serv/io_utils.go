@@ -5,6 +5,9 @@ import (
 	"errors"
 	"github.com/nishoushun/gosshd"
 	"io"
+	"net"
+	"sync"
+	"time"
 )
 
 // NewCopyOnWriteConn 写入网络数据时，复制数据至指定 Writer
@@ -52,19 +55,172 @@ type copyOnReadConn struct {
 	writer io.Writer
 }
 
-// CopyBufferWithContext 导出的 io.CopyBufferWithContext 函数，可传入 Context 对应的 cancelFunc 来终止流之间的复制
+// NewWriteTimeoutChannel 包装 channel，当单次写入（包括 Stderr 的写入）超过 timeout 仍未完成时，调用 onTimeout，
+// 通常用于取消 session 的 context 并关闭 channel，避免停止读取数据的客户端一直占用子进程
+func NewWriteTimeoutChannel(channel gosshd.Channel, timeout time.Duration, onTimeout func()) gosshd.Channel {
+	return &writeTimeoutChannel{
+		Channel:   channel,
+		timeout:   timeout,
+		onTimeout: onTimeout,
+	}
+}
+
+type writeTimeoutChannel struct {
+	gosshd.Channel
+	timeout   time.Duration
+	onTimeout func()
+}
+
+func (c *writeTimeoutChannel) Write(b []byte) (int, error) {
+	watchdog := time.AfterFunc(c.timeout, c.onTimeout)
+	defer watchdog.Stop()
+	return c.Channel.Write(b)
+}
+
+func (c *writeTimeoutChannel) Stderr() io.ReadWriter {
+	return &writeTimeoutStderr{ReadWriter: c.Channel.Stderr(), c: c}
+}
+
+type writeTimeoutStderr struct {
+	io.ReadWriter
+	c *writeTimeoutChannel
+}
+
+func (s *writeTimeoutStderr) Write(b []byte) (int, error) {
+	watchdog := time.AfterFunc(s.c.timeout, s.c.onTimeout)
+	defer watchdog.Stop()
+	return s.ReadWriter.Write(b)
+}
+
+// NewBufferedChannel 包装 channel，写入的数据先缓存，缓存达到 size 字节或者距第一次写入超过 delay 时才写入 channel，
+// 使大量的小块输出（例如 yes 或者冗长的编译输出）合并为较大的 SSH 数据包，减少数据包的数量与 MAC 计算的开销；
+// 写入 Stderr、发送请求（例如 exit-status）、CloseWrite 以及 Close 之前会先写入缓存的数据，保证数据的顺序。
+// 缓存会增加交互式 session 的延迟，所以 delay 应当较小
+func NewBufferedChannel(channel gosshd.Channel, size int, delay time.Duration) gosshd.Channel {
+	return &bufferedChannel{
+		Channel: channel,
+		buf:     make([]byte, 0, size),
+		delay:   delay,
+	}
+}
+
+type bufferedChannel struct {
+	gosshd.Channel
+	mu    sync.Mutex
+	buf   []byte
+	delay time.Duration
+	timer *time.Timer
+	err   error // 异步写入时发生的错误，由之后的 Write 返回
+}
+
+func (c *bufferedChannel) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return 0, c.err
+	}
+	// 缓存无法容纳时，先写入缓存的数据，超出缓存大小的数据直接写入
+	if len(c.buf)+len(b) > cap(c.buf) {
+		if err := c.flushLocked(); err != nil {
+			return 0, err
+		}
+		if len(b) >= cap(c.buf) {
+			return c.Channel.Write(b)
+		}
+	}
+	c.buf = append(c.buf, b...)
+	if c.timer == nil {
+		c.timer = time.AfterFunc(c.delay, c.flushAsync)
+	}
+	return len(b), nil
+}
+
+// Flush 立即写入缓存的数据
+func (c *bufferedChannel) Flush() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.flushLocked()
+}
+
+func (c *bufferedChannel) flushAsync() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.timer = nil
+	if err := c.flushLocked(); err != nil && c.err == nil {
+		c.err = err
+	}
+}
+
+// flushLocked 写入缓存的数据，调用者需要持有锁
+func (c *bufferedChannel) flushLocked() error {
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	if len(c.buf) == 0 {
+		return nil
+	}
+	_, err := c.Channel.Write(c.buf)
+	c.buf = c.buf[:0]
+	return err
+}
+
+func (c *bufferedChannel) Stderr() io.ReadWriter {
+	return &bufferedStderr{ReadWriter: c.Channel.Stderr(), c: c}
+}
+
+func (c *bufferedChannel) SendRequest(name string, wantReply bool, payload []byte) (bool, error) {
+	c.Flush()
+	return c.Channel.SendRequest(name, wantReply, payload)
+}
+
+func (c *bufferedChannel) CloseWrite() error {
+	c.Flush()
+	return c.Channel.CloseWrite()
+}
+
+func (c *bufferedChannel) Close() error {
+	c.Flush()
+	return c.Channel.Close()
+}
+
+type bufferedStderr struct {
+	io.ReadWriter
+	c *bufferedChannel
+}
+
+func (s *bufferedStderr) Write(b []byte) (int, error) {
+	if err := s.c.Flush(); err != nil {
+		return 0, err
+	}
+	return s.ReadWriter.Write(b)
+}
+
+// DefaultCopyBufferSize CopyBufferWithContext 未传入缓冲区时分配的缓冲区大小；
+// 较大的缓冲区可以减少系统调用的次数，提高端口转发中 scp、sftp 等大量数据传输的吞吐量
+var DefaultCopyBufferSize = 128 * 1024
+
+// CopyBufferWithContext 导出的 io.CopyBufferWithContext 函数，可传入 Context 对应的 cancelFunc 来终止流之间的复制；
+// 每次读取之前检查 ctx，buf 为 nil 时分配 DefaultCopyBufferSize 大小的缓冲区。
+// 只有 buf 与 ctx 均为 nil 时才会像 io.Copy 一样使用 src 的 WriteTo 或者 dst 的 ReadFrom，
+// 否则 TCPConn、os.File、pty 等实现了这两个方法的类型将忽略缓冲区大小以及 ctx
 func CopyBufferWithContext(dst io.Writer, src io.Reader, buf []byte, ctx context.Context) (written int64, err error) {
-	// If the reader has a WriteTo method, use it to do the copy.
-	// Avoids an allocation and a copy.
-	if wt, ok := src.(io.WriterTo); ok {
-		return wt.WriteTo(dst)
+	if buf == nil && ctx == nil {
+		// If the reader has a WriteTo method, use it to do the copy.
+		// Avoids an allocation and a copy.
+		if wt, ok := src.(io.WriterTo); ok {
+			return wt.WriteTo(dst)
+		}
+		// Similarly, if the writer has a ReadFrom method, use it to do the copy.
+		if rt, ok := dst.(io.ReaderFrom); ok {
+			return rt.ReadFrom(src)
+		}
 	}
-	// Similarly, if the writer has a ReadFrom method, use it to do the copy.
-	if rt, ok := dst.(io.ReaderFrom); ok {
-		return rt.ReadFrom(src)
+	if ctx == nil {
+		ctx = context.Background()
 	}
 	if buf == nil {
-		size := 32 * 1024
+		size := DefaultCopyBufferSize
 		if l, ok := src.(*io.LimitedReader); ok && int64(size) > l.N {
 			if l.N < 1 {
 				size = 1
@@ -110,6 +266,46 @@ ret:
 	return written, err
 }
 
+// CloseWrite 半关闭 c，使对方读取到 EOF，而另一个方向的数据仍可继续传输；c 不支持半关闭时（例如 unix 以外的 net.Conn）将其关闭
+func CloseWrite(c io.Closer) error {
+	if cw, ok := c.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Close()
+}
+
+// RelayWithContext 在 channel 与 conn 之间双向转发数据，直到两个方向都结束或者 ctx 被取消，之后关闭 channel 与 conn；
+// 一方读取到 EOF 时只半关闭另一方的写入端，使另一个方向的数据可以继续传输；任意一方出错时结束转发；
+// rbuf 用于 conn 至 channel 方向的复制，wbuf 用于 channel 至 conn 方向的复制，为 nil 时自动分配
+func RelayWithContext(ctx context.Context, channel gosshd.Channel, conn net.Conn, rbuf, wbuf []byte) {
+	c, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		<-c.Done()
+		channel.Close()
+		conn.Close()
+	}()
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		if _, err := CopyBufferWithContext(channel, conn, rbuf, c); err != nil {
+			cancel()
+			return
+		}
+		channel.CloseWrite()
+	}()
+	go func() {
+		defer wg.Done()
+		if _, err := CopyBufferWithContext(conn, channel, wbuf, c); err != nil {
+			cancel()
+			return
+		}
+		CloseWrite(conn)
+	}()
+	wg.Wait()
+}
+
 var interruptedErr = errors.New("interrupted")
 var errInvalidWrite = errors.New("invalid write result")
 
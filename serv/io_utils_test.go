@@ -0,0 +1,117 @@
+package serv
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/nishoushun/gosshd"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestCopyBufferWithContextCanceled src 实现了 io.WriterTo、dst 实现了 io.ReaderFrom 时，ctx 被取消后同样不会复制
+func TestCopyBufferWithContextCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	dst := &bytes.Buffer{}
+	n, err := CopyBufferWithContext(dst, strings.NewReader("data"), nil, ctx)
+	if err != interruptedErr || n != 0 || dst.Len() != 0 {
+		t.Fatalf("copied %d bytes, err = %v, want interrupted before copying", n, err)
+	}
+}
+
+// BenchmarkCopyBufferSize 通过回环 TCP 连接传输 64MiB 数据，比较不同缓冲区大小的吞吐量；
+// "default" 为 buf 为 nil 时分配的 DefaultCopyBufferSize 缓冲区，"io.Copy" 为 buf 与 ctx 均为 nil 时使用的 WriteTo、ReadFrom
+func BenchmarkCopyBufferSize(b *testing.B) {
+	const total = 64 << 20
+	tests := []struct {
+		name string
+		size int // 为 0 时 buf 为 nil
+		ctx  context.Context
+	}{
+		{name: "32KiB", size: 32 * 1024, ctx: context.Background()},
+		{name: "default", ctx: context.Background()},
+		{name: "512KiB", size: 512 * 1024, ctx: context.Background()},
+		{name: "io.Copy"},
+	}
+	for _, tt := range tests {
+		tt := tt
+		b.Run(tt.name, func(b *testing.B) {
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer listener.Close()
+			var buf []byte
+			if tt.size > 0 {
+				buf = make([]byte, tt.size)
+			}
+			data := make([]byte, total)
+			b.SetBytes(total)
+			for i := 0; i < b.N; i++ {
+				go func() {
+					conn, err := net.Dial("tcp", listener.Addr().String())
+					if err != nil {
+						return
+					}
+					defer conn.Close()
+					conn.Write(data)
+				}()
+				conn, err := listener.Accept()
+				if err != nil {
+					b.Fatal(err)
+				}
+				n, err := CopyBufferWithContext(ioutil.Discard, conn, buf, tt.ctx)
+				conn.Close()
+				if err != nil || n != total {
+					b.Fatalf("copied %d bytes, err = %v", n, err)
+				}
+			}
+		})
+	}
+}
+
+// packetCountingChannel 记录 Write 的次数，每次 Write 至少对应一个 SSH 数据包
+type packetCountingChannel struct {
+	gosshd.Channel
+	packets int
+}
+
+func (c *packetCountingChannel) Write(b []byte) (int, error) {
+	c.packets++
+	return len(b), nil
+}
+
+func (c *packetCountingChannel) Close() error {
+	return nil
+}
+
+// BenchmarkBufferedChannel 模拟 yes 等命令的大量小块输出，比较缓存前后写入 channel 的次数，即 SSH 数据包的数量
+func BenchmarkBufferedChannel(b *testing.B) {
+	const chunks = 4096
+	line := []byte("y\n")
+	for _, buffered := range []bool{false, true} {
+		b.Run(fmt.Sprintf("buffered=%v", buffered), func(b *testing.B) {
+			b.SetBytes(chunks * int64(len(line)))
+			packets := 0
+			for i := 0; i < b.N; i++ {
+				counter := &packetCountingChannel{}
+				var channel gosshd.Channel = counter
+				if buffered {
+					channel = NewBufferedChannel(counter, 32*1024, 10*time.Millisecond)
+				}
+				for j := 0; j < chunks; j++ {
+					if _, err := channel.Write(line); err != nil {
+						b.Fatal(err)
+					}
+				}
+				channel.Close()
+				packets += counter.packets
+			}
+			b.ReportMetric(float64(packets)/float64(b.N), "packets/op")
+		})
+	}
+}
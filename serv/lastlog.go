@@ -0,0 +1,69 @@
+package serv
+
+import (
+	"github.com/nishoushun/gosshd"
+	"sync"
+	"time"
+)
+
+// LoginRecord 用户的一次登陆记录
+type LoginRecord struct {
+	User string
+	Host string // 客户端的主机名或者地址
+	Time time.Time
+}
+
+// LoginRecorder 用户登陆事件的存储，可以由文件、数据库等实现；
+// DefaultSessionChanHandler 设置了 LoginRecorder 时，分配了 pty 的 shell 启动之前显示用户上一次的登陆时间与主机，并记录本次登陆
+type LoginRecorder interface {
+	Record(user, remoteHost string, t time.Time)
+	Last(user string) (LoginRecord, bool)
+}
+
+// MemoryLoginRecorder 在内存中保存每个用户最近一次的登陆记录，服务器重启后丢失
+type MemoryLoginRecorder struct {
+	sync.Mutex
+	records map[string]LoginRecord
+}
+
+// NewMemoryLoginRecorder 创建一个 MemoryLoginRecorder
+func NewMemoryLoginRecorder() *MemoryLoginRecorder {
+	return &MemoryLoginRecorder{records: map[string]LoginRecord{}}
+}
+
+func (r *MemoryLoginRecorder) Record(user, remoteHost string, t time.Time) {
+	r.Lock()
+	defer r.Unlock()
+	r.records[user] = LoginRecord{User: user, Host: remoteHost, Time: t}
+}
+
+func (r *MemoryLoginRecorder) Last(user string) (LoginRecord, bool) {
+	r.Lock()
+	defer r.Unlock()
+	record, ok := r.records[user]
+	return record, ok
+}
+
+// recordLogin 向客户端发送用户上一次的登陆信息，然后记录本次登陆；未设置 LoginRecorder 时不做任何处理
+func (handler *DefaultSessionChanHandler) recordLogin(ctx gosshd.Context, session gosshd.Channel) error {
+	if handler.LoginRecorder == nil || ctx.User() == nil {
+		return nil
+	}
+	user := ctx.User().UserName
+	if last, ok := handler.LoginRecorder.Last(user); ok {
+		if _, err := session.Write([]byte(toCRLF(lastLoginMessage(last)))); err != nil {
+			return err
+		}
+	}
+	handler.LoginRecorder.Record(user, ctx.RemoteHost(), time.Now())
+	return nil
+}
+
+// lastLoginMessage 生成与 OpenSSH 格式相同的上次登陆信息
+func lastLoginMessage(record LoginRecord) string {
+	msg := "Last login: " + record.Time.Format("Mon Jan _2 15:04:05 2006")
+	if record.Host != "" {
+		msg += " from " + record.Host
+	}
+	return msg + "\n"
+}
@@ -0,0 +1,131 @@
+package serv
+
+import (
+	"fmt"
+	"github.com/nishoushun/gosshd"
+	"net"
+	"path"
+	"strings"
+)
+
+// AccessPolicy 类似于 sshd_config 中的 AllowUsers、DenyUsers、AllowGroups 以及 DenyGroups 选项，
+// 在身份认证之后、处理 channel 之前决定是否允许用户登陆。
+//
+// 用户规则的形式为 USER 或 USER@HOST，HOST 与客户端的 IP 地址以及 Context 的 RemoteHost（开启 UseDNS 时为主机名）进行匹配；
+// 用户与组规则均支持 '*' 与 '?' 通配符，例如 "admin"，"*@192.168.*"；
+// 判断顺序为 DenyUsers、AllowUsers、DenyGroups、AllowGroups，拒绝规则优先于允许规则；
+// 若设置了 AllowUsers 或 AllowGroups，则只有匹配的用户才能登陆。
+type AccessPolicy struct {
+	AllowUsers  []string
+	DenyUsers   []string
+	AllowGroups []string
+	DenyGroups  []string
+
+	// 获取用户所在的组，默认为 UnixUserGroups
+	LookupGroups func(user *gosshd.User) ([]string, error)
+}
+
+// Authorize 可作为 SSHServer 的 AuthorizeConnCallback，用户不满足策略时返回 PermitNotAllowedError
+func (p *AccessPolicy) Authorize(ctx gosshd.Context) error {
+	var username string
+	if user := ctx.User(); user != nil {
+		username = user.UserName
+	} else {
+		username = ctx.Conn().User()
+	}
+	host := ""
+	if ctx.RemoteAddr() != nil {
+		host = ctx.RemoteAddr().String()
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+	}
+	// 只有规则包含 HOST 时才需要主机名，避免不必要的反向解析
+	var hosts []string
+	remoteHosts := func() []string {
+		if hosts == nil {
+			hosts = []string{host}
+			if name := ctx.RemoteHost(); name != "" && name != host {
+				hosts = append(hosts, name)
+			}
+		}
+		return hosts
+	}
+
+	for _, pattern := range p.DenyUsers {
+		if matchUserPattern(pattern, username, remoteHosts) {
+			return gosshd.PermitNotAllowedError{Msg: fmt.Sprintf("user %s from %s is denied", username, host)}
+		}
+	}
+	if len(p.AllowUsers) > 0 {
+		allowed := false
+		for _, pattern := range p.AllowUsers {
+			if matchUserPattern(pattern, username, remoteHosts) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return gosshd.PermitNotAllowedError{Msg: fmt.Sprintf("user %s from %s is not allowed", username, host)}
+		}
+	}
+
+	if len(p.DenyGroups) == 0 && len(p.AllowGroups) == 0 {
+		return nil
+	}
+	user := ctx.User()
+	if user == nil {
+		return gosshd.PermitNotAllowedError{Msg: fmt.Sprintf("groups of user %s unknown", username)}
+	}
+	lookup := p.LookupGroups
+	if lookup == nil {
+		lookup = UnixUserGroups
+	}
+	groups, err := lookup(user)
+	if err != nil {
+		return gosshd.PermitNotAllowedError{Msg: err.Error()}
+	}
+	for _, pattern := range p.DenyGroups {
+		if matchAnyGroup(pattern, groups) {
+			return gosshd.PermitNotAllowedError{Msg: fmt.Sprintf("group of user %s is denied", username)}
+		}
+	}
+	if len(p.AllowGroups) > 0 {
+		for _, pattern := range p.AllowGroups {
+			if matchAnyGroup(pattern, groups) {
+				return nil
+			}
+		}
+		return gosshd.PermitNotAllowedError{Msg: fmt.Sprintf("no group of user %s is allowed", username)}
+	}
+	return nil
+}
+
+// matchUserPattern 匹配 USER 或 USER@HOST 形式的规则，HOST 与 hosts 返回的任意一个地址匹配即可
+func matchUserPattern(pattern, user string, hosts func() []string) bool {
+	userPattern, hostPattern := pattern, ""
+	if i := strings.LastIndex(pattern, "@"); i >= 0 {
+		userPattern, hostPattern = pattern[:i], pattern[i+1:]
+	}
+	if ok, _ := path.Match(userPattern, user); !ok {
+		return false
+	}
+	if hostPattern == "" {
+		return true
+	}
+	for _, host := range hosts() {
+		if ok, _ := path.Match(hostPattern, host); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func matchAnyGroup(pattern string, groups []string) bool {
+	for _, group := range groups {
+		if ok, _ := path.Match(pattern, group); ok {
+			return true
+		}
+	}
+	return false
+}
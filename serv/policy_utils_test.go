@@ -0,0 +1,101 @@
+package serv
+
+import (
+	"errors"
+	"github.com/nishoushun/gosshd"
+	"net"
+	"testing"
+)
+
+// policyContext 只提供 AccessPolicy 使用的用户与地址信息
+type policyContext struct {
+	gosshd.Context
+	user  *gosshd.User
+	raddr net.Addr
+	rhost string
+}
+
+func (ctx *policyContext) User() *gosshd.User {
+	return ctx.user
+}
+
+func (ctx *policyContext) RemoteAddr() net.Addr {
+	return ctx.raddr
+}
+
+func (ctx *policyContext) RemoteHost() string {
+	return ctx.rhost
+}
+
+func TestAccessPolicyAuthorize(t *testing.T) {
+	groups := map[string][]string{
+		"alice": {"alice", "wheel"},
+		"bob":   {"bob", "sftp"},
+		"carol": {"carol", "wheel", "banned"},
+	}
+	lookup := func(user *gosshd.User) ([]string, error) {
+		return groups[user.UserName], nil
+	}
+	tests := []struct {
+		name   string
+		policy AccessPolicy
+		user   string
+		ip     string
+		host   string // RemoteHost，为空时与 ip 相同
+		allow  bool
+	}{
+		{name: "empty policy allows everyone", user: "alice", ip: "10.0.0.1", allow: true},
+		{name: "AllowUsers match", policy: AccessPolicy{AllowUsers: []string{"alice", "bob"}},
+			user: "bob", ip: "10.0.0.1", allow: true},
+		{name: "AllowUsers no match", policy: AccessPolicy{AllowUsers: []string{"alice"}},
+			user: "bob", ip: "10.0.0.1"},
+		{name: "DenyUsers wins over AllowUsers", policy: AccessPolicy{AllowUsers: []string{"*"}, DenyUsers: []string{"bob"}},
+			user: "bob", ip: "10.0.0.1"},
+		{name: "DenyUsers only", policy: AccessPolicy{DenyUsers: []string{"b*"}},
+			user: "alice", ip: "10.0.0.1", allow: true},
+		{name: "user@ip match", policy: AccessPolicy{AllowUsers: []string{"alice@192.168.*"}},
+			user: "alice", ip: "192.168.1.5", allow: true},
+		{name: "user@ip other address", policy: AccessPolicy{AllowUsers: []string{"alice@192.168.*"}},
+			user: "alice", ip: "10.0.0.1"},
+		{name: "user@host matches RemoteHost", policy: AccessPolicy{AllowUsers: []string{"alice@*.example.com"}},
+			user: "alice", ip: "10.0.0.1", host: "ws1.example.com", allow: true},
+		{name: "deny user@host by RemoteHost", policy: AccessPolicy{DenyUsers: []string{"*@*.evil.test"}},
+			user: "alice", ip: "10.0.0.1", host: "x.evil.test"},
+		{name: "AllowGroups match", policy: AccessPolicy{AllowGroups: []string{"wheel"}},
+			user: "alice", ip: "10.0.0.1", allow: true},
+		{name: "AllowGroups no match", policy: AccessPolicy{AllowGroups: []string{"wheel"}},
+			user: "bob", ip: "10.0.0.1"},
+		{name: "DenyGroups wins over AllowGroups", policy: AccessPolicy{AllowGroups: []string{"wheel"}, DenyGroups: []string{"banned"}},
+			user: "carol", ip: "10.0.0.1"},
+		{name: "DenyGroups only", policy: AccessPolicy{DenyGroups: []string{"banned"}},
+			user: "bob", ip: "10.0.0.1", allow: true},
+		{name: "AllowUsers and AllowGroups both apply", policy: AccessPolicy{AllowUsers: []string{"bob"}, AllowGroups: []string{"wheel"}},
+			user: "bob", ip: "10.0.0.1"},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			host := tt.host
+			if host == "" {
+				host = tt.ip
+			}
+			ctx := &policyContext{
+				user:  &gosshd.User{UserName: tt.user},
+				raddr: &net.TCPAddr{IP: net.ParseIP(tt.ip), Port: 50000},
+				rhost: host,
+			}
+			policy := tt.policy
+			policy.LookupGroups = lookup
+			err := policy.Authorize(ctx)
+			if tt.allow && err != nil {
+				t.Fatalf("denied: %v", err)
+			}
+			if !tt.allow {
+				var denied gosshd.PermitNotAllowedError
+				if !errors.As(err, &denied) {
+					t.Fatalf("err = %v, want PermitNotAllowedError", err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,198 @@
+package serv
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"github.com/nishoushun/gosshd"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 本文件包含 HAProxy PROXY 协议 v1 与 v2 的解析，
+// 协议定义于 https://www.haproxy.org/download/2.6/doc/proxy-protocol.txt
+
+// ProxyHeaderTimeout 读取 PROXY 协议头的超时时间
+var ProxyHeaderTimeout = 10 * time.Second
+
+// proxy 协议 v2 的 12 字节签名
+var proxyV2Signature = []byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A}
+
+const (
+	proxyV1Prefix    = "PROXY "
+	proxyV1MaxLength = 107 // v1 协议头最大长度，包括结尾的 CRLF
+	proxyV2HeaderLen = 16  // v2 协议头固定部分长度
+)
+
+// InvalidProxyHeader PROXY 协议头格式错误
+var InvalidProxyHeader = errors.New("invalid proxy protocol header")
+
+// ProxyProtocolConn 返回一个 TransformConnCallback，读取并剥离连接开头的 PROXY 协议头（支持 v1 与 v2），
+// 返回的 net.Conn 的 RemoteAddr 与 LocalAddr 为协议头中记录的真实地址；
+// 对于 v1 的 UNKNOWN 以及 v2 的 LOCAL 命令，保留原始连接的地址；
+// 协议头格式错误或读取超时时返回 error，该连接将被关闭。
+func ProxyProtocolConn() gosshd.TransformConnCallback {
+	return func(conn net.Conn) (net.Conn, error) {
+		if err := conn.SetReadDeadline(time.Now().Add(ProxyHeaderTimeout)); err != nil {
+			return nil, err
+		}
+		reader := bufio.NewReader(conn)
+		pconn := &proxyConn{
+			Conn:   conn,
+			reader: reader,
+			raddr:  conn.RemoteAddr(),
+			laddr:  conn.LocalAddr(),
+		}
+		sig, err := reader.Peek(len(proxyV2Signature))
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case bytes.Equal(sig, proxyV2Signature):
+			err = pconn.readV2Header()
+		case bytes.HasPrefix(sig, []byte(proxyV1Prefix)):
+			err = pconn.readV1Header()
+		default:
+			err = InvalidProxyHeader
+		}
+		if err != nil {
+			return nil, err
+		}
+		// 清除读取超时
+		if err := conn.SetReadDeadline(time.Time{}); err != nil {
+			return nil, err
+		}
+		return pconn, nil
+	}
+}
+
+// proxyConn 剥离 PROXY 协议头之后的连接，地址信息来自协议头
+type proxyConn struct {
+	net.Conn
+	reader *bufio.Reader // 可能缓存了协议头之后的数据
+	raddr  net.Addr
+	laddr  net.Addr
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	return c.raddr
+}
+
+func (c *proxyConn) LocalAddr() net.Addr {
+	return c.laddr
+}
+
+// readV1Header 解析文本格式的协议头，例如："PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n"
+func (c *proxyConn) readV1Header() error {
+	line := make([]byte, 0, proxyV1MaxLength)
+	for {
+		b, err := c.reader.ReadByte()
+		if err != nil {
+			return err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+		if len(line) >= proxyV1MaxLength {
+			return InvalidProxyHeader
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return InvalidProxyHeader
+	}
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return InvalidProxyHeader
+	}
+	switch fields[1] {
+	case "UNKNOWN":
+		return nil
+	case "TCP4", "TCP6":
+	default:
+		return InvalidProxyHeader
+	}
+	if len(fields) != 6 {
+		return InvalidProxyHeader
+	}
+	srcIP, dstIP := net.ParseIP(fields[2]), net.ParseIP(fields[3])
+	if srcIP == nil || dstIP == nil {
+		return InvalidProxyHeader
+	}
+	if (fields[1] == "TCP4") != (srcIP.To4() != nil && dstIP.To4() != nil) {
+		return InvalidProxyHeader
+	}
+	srcPort, err := parseProxyPort(fields[4])
+	if err != nil {
+		return err
+	}
+	dstPort, err := parseProxyPort(fields[5])
+	if err != nil {
+		return err
+	}
+	c.raddr = &net.TCPAddr{IP: srcIP, Port: srcPort}
+	c.laddr = &net.TCPAddr{IP: dstIP, Port: dstPort}
+	return nil
+}
+
+// readV2Header 解析二进制格式的协议头
+func (c *proxyConn) readV2Header() error {
+	header := make([]byte, proxyV2HeaderLen)
+	if _, err := io.ReadFull(c.reader, header); err != nil {
+		return err
+	}
+	verCmd, family := header[12], header[13]
+	if verCmd>>4 != 0x2 {
+		return InvalidProxyHeader
+	}
+	length := binary.BigEndian.Uint16(header[14:16])
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(c.reader, payload); err != nil {
+		return err
+	}
+	switch verCmd & 0x0F {
+	case 0x0: // LOCAL，由代理自身发起的连接，使用原始地址
+		return nil
+	case 0x1: // PROXY
+	default:
+		return InvalidProxyHeader
+	}
+
+	var ipLen int
+	switch family >> 4 {
+	case 0x1: // AF_INET
+		ipLen = net.IPv4len
+	case 0x2: // AF_INET6
+		ipLen = net.IPv6len
+	case 0x0, 0x3: // AF_UNSPEC 以及 AF_UNIX，无法表示为 TCP 地址，使用原始地址
+		return nil
+	default:
+		return InvalidProxyHeader
+	}
+	if int(length) < ipLen*2+4 {
+		return InvalidProxyHeader
+	}
+	srcIP := net.IP(append([]byte(nil), payload[:ipLen]...))
+	dstIP := net.IP(append([]byte(nil), payload[ipLen:ipLen*2]...))
+	srcPort := binary.BigEndian.Uint16(payload[ipLen*2 : ipLen*2+2])
+	dstPort := binary.BigEndian.Uint16(payload[ipLen*2+2 : ipLen*2+4])
+	c.raddr = &net.TCPAddr{IP: srcIP, Port: int(srcPort)}
+	c.laddr = &net.TCPAddr{IP: dstIP, Port: int(dstPort)}
+	return nil
+}
+
+func parseProxyPort(s string) (int, error) {
+	port, err := strconv.Atoi(s)
+	if err != nil || port < 0 || port > 65535 {
+		return 0, InvalidProxyHeader
+	}
+	return port, nil
+}
@@ -0,0 +1,130 @@
+package serv
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// proxyV2Header 生成 v2 协议头，payload 为地址部分
+func proxyV2Header(verCmd, family byte, payload []byte) []byte {
+	header := append([]byte(nil), proxyV2Signature...)
+	header = append(header, verCmd, family, 0, 0)
+	binary.BigEndian.PutUint16(header[14:], uint16(len(payload)))
+	return append(header, payload...)
+}
+
+// deadlineConn 记录最后一次设置的读取超时
+type deadlineConn struct {
+	net.Conn
+	readDeadline time.Time
+}
+
+func (c *deadlineConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline = t
+	return c.Conn.SetReadDeadline(t)
+}
+
+func TestProxyProtocolConn(t *testing.T) {
+	v4 := append(net.IPv4(192, 168, 0, 1).To4(), net.IPv4(192, 168, 0, 11).To4()...)
+	v4 = append(v4, 0xdc, 0x04, 0x01, 0xbb) // 56324, 443
+	v6 := append(net.ParseIP("2001:db8::1").To16(), net.ParseIP("2001:db8::2").To16()...)
+	v6 = append(v6, 0xdc, 0x04, 0x00, 0x16) // 56324, 22
+
+	const original = "pipe"
+	tests := []struct {
+		name    string
+		header  []byte
+		raddr   string // 为空时期望返回 error
+		laddr   string
+		invalid bool // 期望返回 InvalidProxyHeader
+	}{
+		{name: "v1 TCP4", header: []byte("PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n"),
+			raddr: "192.168.0.1:56324", laddr: "192.168.0.11:443"},
+		{name: "v1 TCP6", header: []byte("PROXY TCP6 2001:db8::1 2001:db8::2 56324 22\r\n"),
+			raddr: "[2001:db8::1]:56324", laddr: "[2001:db8::2]:22"},
+		{name: "v1 UNKNOWN", header: []byte("PROXY UNKNOWN ffff::1 ffff::2 1 2\r\n"),
+			raddr: original, laddr: original},
+		{name: "v1 TCP4 with IPv6 address", header: []byte("PROXY TCP4 2001:db8::1 192.168.0.11 56324 443\r\n"), invalid: true},
+		{name: "v1 bad port", header: []byte("PROXY TCP4 192.168.0.1 192.168.0.11 65536 443\r\n"), invalid: true},
+		{name: "v1 missing CR", header: []byte("PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\n"), invalid: true},
+		{name: "v1 over-long line", header: []byte("PROXY TCP4 " + strings.Repeat("1", 200) + "\r\n"), invalid: true},
+		{name: "not a proxy header", header: []byte("SSH-2.0-OpenSSH_9.0\r\n"), invalid: true},
+		{name: "v2 TCP4", header: proxyV2Header(0x21, 0x11, v4),
+			raddr: "192.168.0.1:56324", laddr: "192.168.0.11:443"},
+		{name: "v2 TCP6", header: proxyV2Header(0x21, 0x21, v6),
+			raddr: "[2001:db8::1]:56324", laddr: "[2001:db8::2]:22"},
+		{name: "v2 LOCAL", header: proxyV2Header(0x20, 0x00, nil),
+			raddr: original, laddr: original},
+		{name: "v2 bad version", header: proxyV2Header(0x11, 0x11, v4), invalid: true},
+		{name: "v2 short address block", header: proxyV2Header(0x21, 0x11, v4[:6]), invalid: true},
+		{name: "v2 truncated header", header: proxyV2Header(0x21, 0x11, v4)[:14]},
+		{name: "v2 truncated address block", header: proxyV2Header(0x21, 0x11, v4)[:20]},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			server, client := net.Pipe()
+			defer server.Close()
+			const data = "SSH-2.0-client\r\n"
+			go func() {
+				client.Write(tt.header)
+				if tt.raddr != "" {
+					client.Write([]byte(data))
+				}
+				client.Close()
+			}()
+			conn := &deadlineConn{Conn: server}
+			pconn, err := ProxyProtocolConn()(conn)
+			if tt.raddr == "" {
+				if err == nil {
+					t.Fatalf("accepted %q", tt.header)
+				}
+				if tt.invalid && !errors.Is(err, InvalidProxyHeader) {
+					t.Fatalf("err = %v, want InvalidProxyHeader", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			raddr, laddr := tt.raddr, tt.laddr
+			if raddr == original {
+				raddr, laddr = server.RemoteAddr().String(), server.LocalAddr().String()
+			}
+			if pconn.RemoteAddr().String() != raddr || pconn.LocalAddr().String() != laddr {
+				t.Fatalf("addr = %s -> %s, want %s -> %s", pconn.RemoteAddr(), pconn.LocalAddr(), raddr, laddr)
+			}
+			if !conn.readDeadline.IsZero() {
+				t.Fatalf("read deadline %v not cleared", conn.readDeadline)
+			}
+			// 协议头之后的数据应当原样读出
+			rest, err := ioutil.ReadAll(pconn)
+			if err != nil && err != io.EOF {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(rest, []byte(data)) {
+				t.Fatalf("read %q after header, want %q", rest, data)
+			}
+		})
+	}
+}
+
+// TestProxyProtocolConnTimeout 客户端不发送协议头时，读取在 ProxyHeaderTimeout 之后失败
+func TestProxyProtocolConnTimeout(t *testing.T) {
+	timeout := ProxyHeaderTimeout
+	ProxyHeaderTimeout = 50 * time.Millisecond
+	defer func() { ProxyHeaderTimeout = timeout }()
+	server, client := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	if _, err := ProxyProtocolConn()(server); err == nil {
+		t.Fatal("no error without a header")
+	}
+}
@@ -1,6 +1,8 @@
 package serv
 
 import (
+	"github.com/nishoushun/gosshd"
+	"math"
 	"os"
 	"os/exec"
 	"strconv"
@@ -17,7 +19,48 @@ type Winsize struct {
 	Y    uint16 // ws_ypixel: Height in pixels
 }
 
-// StartPtyWithSize 类似于 StartPtyWithAttrs，设置初始大小
+// pty-req 请求中的行数或列数为 0 时使用的终端大小，与 OpenSSH 相同
+const (
+	DefaultPtyRows = 24
+	DefaultPtyCols = 80
+)
+
+// FromPtyRequest 以 pty-req 请求中的终端大小设置 ws，并返回 ws；
+// 部分客户端请求 0x0 的终端，之后才通过 window-change 设置实际大小，此时行数、列数分别使用 DefaultPtyRows、DefaultPtyCols，
+// 避免 curses 等程序在第一次 window-change 之前无法显示
+func (ws *Winsize) FromPtyRequest(msg *gosshd.PtyRequestMsg) *Winsize {
+	ws.Rows, ws.Cols = clampUint16(msg.Rows), clampUint16(msg.Columns)
+	ws.X, ws.Y = clampUint16(msg.Width), clampUint16(msg.Height)
+	if ws.Rows == 0 {
+		ws.Rows = DefaultPtyRows
+	}
+	if ws.Cols == 0 {
+		ws.Cols = DefaultPtyCols
+	}
+	return ws
+}
+
+// FromWindowChange 以 window-change 请求中的终端大小设置 ws，并返回 ws
+func (ws *Winsize) FromWindowChange(msg *gosshd.PtyWindowChangeMsg) *Winsize {
+	ws.Rows, ws.Cols = clampUint16(msg.Rows), clampUint16(msg.Columns)
+	ws.X, ws.Y = clampUint16(msg.Width), clampUint16(msg.Height)
+	return ws
+}
+
+// ApplyWindowChange 将 window-change 请求中的终端大小应用于 pty
+func ApplyWindowChange(pty *os.File, msg *gosshd.PtyWindowChangeMsg) error {
+	return Setsize(pty, (&Winsize{}).FromWindowChange(msg))
+}
+
+// clampUint16 请求中的大小为 uint32，超出 uint16 范围时取最大值，避免截断为错误的大小
+func clampUint16(v uint32) uint16 {
+	if v > math.MaxUint16 {
+		return math.MaxUint16
+	}
+	return uint16(v)
+}
+
+// StartPtyWithSize 类似于 StartPtyWithAttrs，设置初始大小，并使 tty 成为子进程的控制终端
 func StartPtyWithSize(cmd *exec.Cmd, ws *Winsize) (*os.File, *os.File, error) {
 	if cmd.SysProcAttr == nil {
 		cmd.SysProcAttr = &syscall.SysProcAttr{}
@@ -27,7 +70,8 @@ func StartPtyWithSize(cmd *exec.Cmd, ws *Winsize) (*os.File, *os.File, error) {
 	return StartPtyWithAttrs(cmd, ws, cmd.SysProcAttr)
 }
 
-// StartPtyWithAttrs 返回创建 pty、tty，将 cmd 的输入输出绑定到 tty，然后返回对应的 pty,tty
+// StartPtyWithAttrs 创建 pty、tty，将 cmd 的输入输出绑定到 tty，然后返回对应的 pty,tty；
+// 不会启动 cmd，调用者可以在 cmd.Start 之前根据 tty 的名称修改 cmd（例如设置 SSH_TTY 环境变量）
 func StartPtyWithAttrs(c *exec.Cmd, sz *Winsize, attrs *syscall.SysProcAttr) (*os.File, *os.File, error) {
 	ptyF, tty, err := Open()
 	if err != nil {
@@ -0,0 +1,143 @@
+package serv
+
+import (
+	"errors"
+	"github.com/nishoushun/gosshd"
+	"io"
+	"sync"
+	"time"
+)
+
+// RateLimiter 令牌桶限速器，以字节为单位，每秒补充 rate 个令牌，最多积累 burst 个
+type RateLimiter struct {
+	sync.Mutex
+	rate   float64
+	burst  int
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter 创建一个每秒允许 bytesPerSec 个字节的 RateLimiter，最多允许一次性传输一秒的配额
+func NewRateLimiter(bytesPerSec int) *RateLimiter {
+	return &RateLimiter{
+		rate:   float64(bytesPerSec),
+		burst:  bytesPerSec,
+		tokens: float64(bytesPerSec),
+		last:   time.Now(),
+	}
+}
+
+// Burst 单次 Wait 允许的最大字节数
+func (l *RateLimiter) Burst() int {
+	return l.burst
+}
+
+// Wait 取出 n 个令牌，令牌不足时等待至补充足够的令牌，done 被关闭时返回 RateLimitInterruptedErr；n 不应超过 Burst
+func (l *RateLimiter) Wait(n int, done <-chan struct{}) error {
+	l.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > float64(l.burst) {
+		l.tokens = float64(l.burst)
+	}
+	l.last = now
+	// 先预留令牌，使同时等待的调用者按顺序获得配额
+	l.tokens -= float64(n)
+	delay := time.Duration(-l.tokens / l.rate * float64(time.Second))
+	l.Unlock()
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-done:
+		return RateLimitInterruptedErr
+	}
+}
+
+// RateLimitInterruptedErr 限速的 channel 在等待配额时被关闭
+var RateLimitInterruptedErr = errors.New("rate limited channel closed")
+
+// NewRateLimitedChannel 包装 channel，限制每个方向每秒传输的字节数：写入（包括 Stderr）共用一个配额，读取使用另一个配额；
+// 可用于多租户网关中避免单个 channel 占满带宽。bytesPerSec 不大于 0 时不限速，直接返回 channel；
+// Close 会中断正在等待配额的读写
+func NewRateLimitedChannel(channel gosshd.Channel, bytesPerSec int) gosshd.Channel {
+	if bytesPerSec <= 0 {
+		return channel
+	}
+	return &rateLimitedChannel{
+		Channel: channel,
+		read:    NewRateLimiter(bytesPerSec),
+		write:   NewRateLimiter(bytesPerSec),
+		done:    make(chan struct{}),
+	}
+}
+
+type rateLimitedChannel struct {
+	gosshd.Channel
+	read  *RateLimiter
+	write *RateLimiter
+	done  chan struct{}
+	once  sync.Once
+}
+
+func (c *rateLimitedChannel) Read(b []byte) (int, error) {
+	// 读取之后才知道字节数，所以限制单次读取的长度，之后再等待配额
+	if len(b) > c.read.Burst() {
+		b = b[:c.read.Burst()]
+	}
+	n, err := c.Channel.Read(b)
+	if n > 0 {
+		if werr := c.read.Wait(n, c.done); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+func (c *rateLimitedChannel) Write(b []byte) (int, error) {
+	return limitedWrite(c.Channel, b, c.write, c.done)
+}
+
+func (c *rateLimitedChannel) Stderr() io.ReadWriter {
+	return &rateLimitedStderr{ReadWriter: c.Channel.Stderr(), c: c}
+}
+
+func (c *rateLimitedChannel) Close() error {
+	c.once.Do(func() {
+		close(c.done)
+	})
+	return c.Channel.Close()
+}
+
+type rateLimitedStderr struct {
+	io.ReadWriter
+	c *rateLimitedChannel
+}
+
+func (s *rateLimitedStderr) Write(b []byte) (int, error) {
+	return limitedWrite(s.ReadWriter, b, s.c.write, s.c.done)
+}
+
+// limitedWrite 将 b 分为不超过 Burst 的数据块，取得每块的配额之后写入 w
+func limitedWrite(w io.Writer, b []byte, limiter *RateLimiter, done <-chan struct{}) (written int, err error) {
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > limiter.Burst() {
+			chunk = chunk[:limiter.Burst()]
+		}
+		if err := limiter.Wait(len(chunk), done); err != nil {
+			return written, err
+		}
+		n, err := w.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		b = b[n:]
+	}
+	return written, nil
+}
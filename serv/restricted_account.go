@@ -0,0 +1,97 @@
+package serv
+
+import (
+	"fmt"
+	"github.com/nishoushun/gosshd"
+)
+
+// RestrictedAccountOptions 受限账户的配置
+type RestrictedAccountOptions struct {
+	Users      []string // 只允许使用 sftp 的用户，为空时所有用户均受限
+	SftpServer string   // sftp-server 程序路径，为空时通过 LookupSftpServer 查找
+}
+
+// RestrictedAccountHandler 只允许受限用户使用 sftp，拒绝 shell、exec、pty-req、端口转发以及其余所有 channel 与全局请求
+type RestrictedAccountHandler struct {
+	opts  RestrictedAccountOptions
+	users map[string]struct{}
+}
+
+// RestrictedAccount 创建一个 RestrictedAccountHandler，用于搭建“仅文件传输”的服务器，例如：
+//
+//	server, _ := serv.SimpleServerOnUnix()
+//	serv.RestrictedAccount(serv.RestrictedAccountOptions{Users: []string{"drop"}}).Install(server)
+//	log.Fatalln(server.ListenAndServe(":2222"))
+func RestrictedAccount(opts RestrictedAccountOptions) *RestrictedAccountHandler {
+	users := map[string]struct{}{}
+	for _, u := range opts.Users {
+		users[u] = struct{}{}
+	}
+	return &RestrictedAccountHandler{opts: opts, users: users}
+}
+
+// IsRestricted 判断当前连接的用户是否受限
+func (r *RestrictedAccountHandler) IsRestricted(ctx gosshd.Context) bool {
+	if len(r.users) == 0 {
+		return true
+	}
+	var username string
+	if user := ctx.User(); user != nil {
+		username = user.UserName
+	} else {
+		username = ctx.Conn().User()
+	}
+	_, ok := r.users[username]
+	return ok
+}
+
+// HandleSession 处理受限用户的 session 类型的 channel，只注册 sftp subsystem 的处理函数，其余请求均被拒绝
+func (r *RestrictedAccountHandler) HandleSession(ctx gosshd.Context, c gosshd.NewChannel) {
+	sftpServer := r.opts.SftpServer
+	if sftpServer == "" {
+		var err error
+		if sftpServer, err = LookupSftpServer(); err != nil {
+			c.Reject(gosshd.ResourceShortage, err.Error())
+			return
+		}
+	}
+	handler := NewSessionHandler(1, 1, 0)
+	handler.SetSubsystem(SftpSubsystem, sftpServer)
+	handler.SetReqHandlerFunc(gosshd.ReqSubsystem, handler.HandleSubsystemReq)
+	handler.Start(ctx, c)
+}
+
+// Install 为 sshd 安装受限账户处理：受限用户只能建立 session 类型的 channel，并交由 HandleSession 处理，
+// 其余类型的 channel 以及所有全局请求均通过 ChannelOpenPolicy 与 GlobalRequestPolicy 拒绝，对 Install 之后注册的处理函数同样有效；
+// 其余用户仍使用 sshd 原有的处理函数与策略。
+// 注意：session 的处理函数需要在 Install 之前注册，Install 之后再次注册 session 处理函数将覆盖受限用户的处理
+func (r *RestrictedAccountHandler) Install(sshd *gosshd.SSHServer) {
+	sessionHandler, _ := sshd.ChannelHandler(gosshd.SessionTypeChannel)
+	sshd.NewChannel(gosshd.SessionTypeChannel, func(ctx gosshd.Context, c gosshd.NewChannel) {
+		if r.IsRestricted(ctx) {
+			r.HandleSession(ctx, c)
+		} else if sessionHandler != nil {
+			sessionHandler(ctx, c)
+		} else {
+			c.Reject(gosshd.UnknownChannelType, fmt.Sprintf("not support %s", c.ChannelType()))
+		}
+	})
+
+	channelPolicy := sshd.ChannelOpenPolicy
+	sshd.ChannelOpenPolicy = func(ctx gosshd.Context, chType string, extra []byte) (bool, gosshd.RejectionReason, string) {
+		if chType != gosshd.SessionTypeChannel && r.IsRestricted(ctx) {
+			return true, gosshd.Prohibited, "restricted account"
+		}
+		if channelPolicy != nil {
+			return channelPolicy(ctx, chType, extra)
+		}
+		return false, 0, ""
+	}
+	requestPolicy := sshd.GlobalRequestPolicy
+	sshd.GlobalRequestPolicy = func(ctx gosshd.Context, reqType string, payload []byte) bool {
+		if r.IsRestricted(ctx) {
+			return true
+		}
+		return requestPolicy != nil && requestPolicy(ctx, reqType, payload)
+	}
+}
@@ -0,0 +1,59 @@
+package serv
+
+import (
+	"github.com/nishoushun/gosshd"
+	"github.com/nishoushun/gosshd/serv/testutil"
+	"golang.org/x/crypto/ssh"
+	"testing"
+)
+
+// TestRestrictedAccountInstall Install 之后注册的 channel 与全局请求处理函数对受限用户同样不可用
+func TestRestrictedAccountInstall(t *testing.T) {
+	const chType, reqType = "test@gosshd", "test-request@gosshd"
+	tests := []struct {
+		name       string
+		users      []string
+		restricted bool
+	}{
+		{name: "restricted user", users: []string{testutil.User}, restricted: true},
+		{name: "all users restricted", restricted: true},
+		{name: "other user", users: []string{"other"}},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			_, dial := testutil.NewTestServer(func(sshd *gosshd.SSHServer) {
+				RestrictedAccount(RestrictedAccountOptions{Users: tt.users}).Install(sshd)
+				sshd.NewChannel(chType, func(ctx gosshd.Context, c gosshd.NewChannel) {
+					c.Reject(gosshd.ConnectionFailed, "test")
+				})
+				sshd.NewGlobalRequest(reqType, func(ctx gosshd.Context, request gosshd.Request) {
+					request.Reply(true, nil)
+				})
+			})
+			client := dial()
+			defer client.Close()
+
+			_, _, err := client.OpenChannel(chType, nil)
+			openErr, ok := err.(*ssh.OpenChannelError)
+			if !ok {
+				t.Fatalf("OpenChannel err = %v, want *ssh.OpenChannelError", err)
+			}
+			reason := ssh.ConnectionFailed
+			if tt.restricted {
+				reason = ssh.Prohibited
+			}
+			if openErr.Reason != reason {
+				t.Fatalf("OpenChannel rejected with %v, want %v", openErr.Reason, reason)
+			}
+
+			accepted, _, err := client.SendRequest(reqType, true, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if accepted == tt.restricted {
+				t.Fatalf("global request accepted = %v, want %v", accepted, !tt.restricted)
+			}
+		})
+	}
+}
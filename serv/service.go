@@ -0,0 +1,67 @@
+package serv
+
+import (
+	"github.com/nishoushun/gosshd"
+	"time"
+)
+
+// ChannelService 在进程内实现的 exec、subsystem 服务，例如键值协议、聊天服务等，不需要启动子进程；
+// 服务直接读写 ch 的字节流，session 中包含请求的命令以及之后的 signal、window-change 请求；
+// ctx 被取消（例如客户端断开连接）时应当尽快返回，返回值将作为 exit-status 发送至客户端，之后 session 被关闭
+type ChannelService interface {
+	Serve(ctx gosshd.Context, ch gosshd.Channel, session *ServiceSession) int
+}
+
+// ChannelServiceFunc 将普通函数作为 ChannelService 使用
+type ChannelServiceFunc func(ctx gosshd.Context, ch gosshd.Channel, session *ServiceSession) int
+
+func (f ChannelServiceFunc) Serve(ctx gosshd.Context, ch gosshd.Channel, session *ServiceSession) int {
+	return f(ctx, ch, session)
+}
+
+// ServiceSession ChannelService 所在 session 的信息
+type ServiceSession struct {
+	Command       string                            // exec 请求的命令行（经过 CommandRewriter 改写），或者 subsystem 名称
+	Subsystem     bool                              // 为 true 时 Command 为 subsystem 名称
+	Pty           *gosshd.PtyRequestMsg             // 客户端请求的 pty，未请求时为 nil；服务自行处理终端的行为
+	Env           []string                          // session 的环境变量
+	Signals       <-chan *gosshd.SignalMsg          // 客户端之后发送的 signal 请求
+	WindowChanges <-chan *gosshd.PtyWindowChangeMsg // 客户端之后发送的 window-change 请求
+}
+
+// SetService 设置 subsystem 对应的进程内服务，优先于 SetSubsystem 设置的命令行；可以在处理 session 的同时调用
+func (handler *DefaultSessionChanHandler) SetService(subsystem string, service ChannelService) {
+	handler.Lock()
+	defer handler.Unlock()
+	if handler.Services == nil {
+		handler.Services = map[string]ChannelService{}
+	}
+	handler.Services[subsystem] = service
+}
+
+// service 在持有锁时查找 subsystem 对应的进程内服务
+func (handler *DefaultSessionChanHandler) service(subsystem string) (ChannelService, bool) {
+	handler.Lock()
+	defer handler.Unlock()
+	service, ok := handler.Services[subsystem]
+	return service, ok
+}
+
+// serveService 接受请求并调用 service，发送其返回值作为 exit-status，之后关闭 session
+func (handler *DefaultSessionChanHandler) serveService(ctx gosshd.Context, request gosshd.Request, command string, subsystem bool,
+	service ChannelService, session gosshd.Channel) error {
+	request.Reply(true, nil)
+	start := time.Now()
+	code := service.Serve(ctx, session, &ServiceSession{
+		Command:       command,
+		Subsystem:     subsystem,
+		Pty:           handler.PtyMsg(ctx),
+		Env:           handler.Env(ctx),
+		Signals:       handler.SignalMsg(ctx),
+		WindowChanges: handler.WinchMsg(ctx),
+	})
+	if handler.CommandAuditCallback != nil {
+		handler.CommandAuditCallback(ctx, command, code, time.Since(start))
+	}
+	return handler.SendExitStatus(code, true, session)
+}
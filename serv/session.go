@@ -7,79 +7,142 @@ import (
 	"github.com/anmitsu/go-shlex"
 	"github.com/nishoushun/gosshd"
 	"golang.org/x/crypto/ssh"
+	"io"
+	"net"
+	"os"
 	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
 	"sync"
 	"syscall"
+	"time"
 )
 
-// Env 获取设置的环境变量
-func (handler *DefaultSessionChanHandler) Env() []string {
-	return handler.env
+// SessionState 单个 session 的状态，包括请求队列以及环境变量；
+// 由 Start 为每个 session 创建并保存在 session 的 Context 中，使同一个 DefaultSessionChanHandler 可以同时处理多个 session。
+// 同一个 session 的请求由多个协程同时处理，所以 env 与 pty 只能在持有锁时读写，并且不会返回或保存调用者的切片，
+// 应当通过 Env、SetEnv、PtyMsg、PutPtyMsg 访问；请求队列本身是并发安全的，不需要持有锁
+type SessionState struct {
+	sync.Mutex
+	winchCh chan *gosshd.PtyWindowChangeMsg // window-change 请求队列
+	sigCh   chan *gosshd.SignalMsg          // signal 请求队列
+	pty     *gosshd.PtyRequestMsg           // 尚未被 shell、exec 请求使用的 pty-req 请求，由锁保护
+	env     []string                        // 该 session 环境变量，由锁保护
+}
+
+type sessionStateKey struct{}
+
+// newSessionState 创建一个 SessionState，环境变量初始化为 env 的副本
+func (handler *DefaultSessionChanHandler) newSessionState(env []string) *SessionState {
+	return &SessionState{
+		winchCh: make(chan *gosshd.PtyWindowChangeMsg, handler.winMsgBufSize),
+		sigCh:   make(chan *gosshd.SignalMsg, handler.sigMsgBufSize),
+		env:     append(make([]string, 0, len(env)), env...),
+	}
+}
+
+// Session 返回 ctx 所属 session 的状态；ctx 不是由 Start 创建的 session Context 时（例如为 nil），返回处理器自身的默认状态
+func (handler *DefaultSessionChanHandler) Session(ctx gosshd.Context) *SessionState {
+	if ctx != nil {
+		if state, ok := ctx.Value(sessionStateKey{}).(*SessionState); ok {
+			return state
+		}
+	}
+	return handler.defaults
+}
+
+// Env 获取 session 设置的环境变量
+func (handler *DefaultSessionChanHandler) Env(ctx gosshd.Context) []string {
+	state := handler.Session(ctx)
+	state.Lock()
+	defer state.Unlock()
+	return append([]string(nil), state.env...)
+}
+
+// SetEnv 设置 session 的环境变量，单个的形式应该为 %s=%s；保存的是 env 的副本，之后修改 env 不会影响 session；
+// ctx 为 nil 时设置的是默认环境变量，之后开始的 session 将以其作为初始环境变量
+func (handler *DefaultSessionChanHandler) SetEnv(ctx gosshd.Context, env []string) {
+	state := handler.Session(ctx)
+	state.Lock()
+	defer state.Unlock()
+	state.env = append(make([]string, 0, len(env)), env...)
 }
 
-// SetEnv 设置环境变量，单个的形式应该为 %s=%s
-func (handler *DefaultSessionChanHandler) SetEnv(env []string) {
-	handler.env = env
+// PtyMsg 取出 session 最新的 pty-req 请求信息，客户端没有请求 pty 时返回 nil；
+// 取出与清除在同一个锁中完成，每个 pty-req 请求只会被一个 shell 或者 exec 请求使用
+func (handler *DefaultSessionChanHandler) PtyMsg(ctx gosshd.Context) *gosshd.PtyRequestMsg {
+	state := handler.Session(ctx)
+	state.Lock()
+	defer state.Unlock()
+	msg := state.pty
+	state.pty = nil
+	return msg
 }
 
-// PtyMsg 从缓存队列中取出最新的 pty-req 请求信息，若无，则阻塞至一个客户端发送一个新的 pty-req 请求
-func (handler *DefaultSessionChanHandler) PtyMsg() <-chan *gosshd.PtyRequestMsg {
-	return handler.ptyCh
+// WinchMsg 从 session 的缓存队列中取出最新的 window-change 请求信息，若无，则阻塞至一个客户端发送一个新的 window-change 请求
+func (handler *DefaultSessionChanHandler) WinchMsg(ctx gosshd.Context) <-chan *gosshd.PtyWindowChangeMsg {
+	return handler.Session(ctx).winchCh
 }
 
-// WinchMsg 从缓存队列中取出最新的 window-change 请求信息，若无，则阻塞至一个客户端发送一个新的 window-change 请求
-func (handler *DefaultSessionChanHandler) WinchMsg() <-chan *gosshd.PtyWindowChangeMsg {
-	return handler.winchCh
+// SignalMsg 从 session 的缓存队列中取出最新的 signal 请求信息，若无，则阻塞至一个客户端发送一个新的 signal 请求
+func (handler *DefaultSessionChanHandler) SignalMsg(ctx gosshd.Context) <-chan *gosshd.SignalMsg {
+	return handler.Session(ctx).sigCh
 }
 
-// SignalMsg 从缓存队列中取出最新的 signal 请求信息，若无，则阻塞至一个客户端发送一个新的 signal 请求
-func (handler *DefaultSessionChanHandler) SignalMsg() <-chan *gosshd.SignalMsg {
-	return handler.sigCh
+// PutPtyMsg 保存 session 的 pty-req 请求信息，替换尚未被使用的 pty-req 请求
+func (handler *DefaultSessionChanHandler) PutPtyMsg(ctx gosshd.Context, msg *gosshd.PtyRequestMsg) {
+	state := handler.Session(ctx)
+	state.Lock()
+	defer state.Unlock()
+	state.pty = msg
 }
 
-// PutPtyMsg 放入 pty-req 请求信息至缓存队列中，若队列满，则阻塞至一个 pty-req 请求被取出
-func (handler *DefaultSessionChanHandler) PutPtyMsg(msg *gosshd.PtyRequestMsg) {
-	handler.ptyCh <- msg
+// PutWinchMsg 放入 window-change 请求信息至 session 的缓存队列中，若队列满，则阻塞至一个 window-change 请求被取出
+func (handler *DefaultSessionChanHandler) PutWinchMsg(ctx gosshd.Context, msg *gosshd.PtyWindowChangeMsg) {
+	handler.Session(ctx).winchCh <- msg
 }
 
-// PutWinchMsg 放入 window-change 请求信息至缓存队列中，若队列满，则阻塞至一个 window-change 请求被取出
-func (handler *DefaultSessionChanHandler) PutWinchMsg(msg *gosshd.PtyWindowChangeMsg) {
-	handler.winchCh <- msg
+// PutSignalMsg 放入 signal 请求信息至 session 的缓存队列中，若队列满，则阻塞至一个 signal 请求被取出
+func (handler *DefaultSessionChanHandler) PutSignalMsg(ctx gosshd.Context, msg *gosshd.SignalMsg) {
+	handler.Session(ctx).sigCh <- msg
 }
 
-// PutSignalMsg 放入 signal 请求信息至缓存队列中，若队列满，则阻塞至一个 signal 请求被取出
-func (handler *DefaultSessionChanHandler) PutSignalMsg(msg *gosshd.SignalMsg) {
-	handler.sigCh <- msg
+// NewSessionChannelHandler 创建一个 DefaultSessionChanHandler，ptyMsgBufSize 不再使用，其余参数与 NewSessionHandler 相同。
+//
+// Deprecated: pty-req 请求不再通过队列传递，请使用 NewSessionHandler。
+func NewSessionChannelHandler(winMsgBufSize, ptyMsgBufSize, sigMsgBufSize, copyBufSize int) *DefaultSessionChanHandler {
+	return NewSessionHandler(winMsgBufSize, sigMsgBufSize, copyBufSize)
 }
 
-// NewSessionChannelHandler  创建一个 DefaultSessionChanHandler。
-// winMsgBufSize 为 window-change 消息队列最大长度；
-// ptyMsgBufSize 为 pty-req 消息队列最大长度；
-// sigMsgBufSize 为 signal 消息队列最大长度；
+// NewSessionHandler 创建一个 DefaultSessionChanHandler，同一个实例可以同时处理多个 session。
+// winMsgBufSize 为每个 session 的 window-change 消息队列最大长度；
+// sigMsgBufSize 为每个 session 的 signal 消息队列最大长度；
 // copyBuf 用于客户端 与 session 数据流的缓存；
 // 注意：消息队列最大长度设置的太小，容易导致死锁。
-func NewSessionChannelHandler(winMsgBufSize, ptyMsgBufSize, sigMsgBufSize, copyBufSize int) *DefaultSessionChanHandler {
+func NewSessionHandler(winMsgBufSize, sigMsgBufSize, copyBufSize int) *DefaultSessionChanHandler {
 	if winMsgBufSize < 0 {
 		winMsgBufSize = 1
 	}
 
-	if ptyMsgBufSize < 0 {
-		ptyMsgBufSize = 1
-	}
-
 	if sigMsgBufSize < 0 {
 		sigMsgBufSize = 1
 	}
 
 	handler := &DefaultSessionChanHandler{
-		Mutex:       sync.Mutex{},
-		winchCh:     make(chan *gosshd.PtyWindowChangeMsg, winMsgBufSize),
-		ptyCh:       make(chan *gosshd.PtyRequestMsg, ptyMsgBufSize),
-		sigCh:       make(chan *gosshd.SignalMsg, sigMsgBufSize),
-		env:         make([]string, 0),
-		copyBufSize: copyBufSize,
-		ReqHandlers: map[string]RequestHandlerFunc{},
+		Mutex:          sync.Mutex{},
+		winMsgBufSize:  winMsgBufSize,
+		sigMsgBufSize:  sigMsgBufSize,
+		copyBufSize:    copyBufSize,
+		LoginProgram:   append([]string(nil), DefaultLoginProgram...),
+		PermitTTY:      true,
+		MaxEnvVars:     DefaultMaxEnvVars,
+		DropPrivileges: true,
+		ReqHandlers:    map[string]RequestHandlerFunc{},
+		Subsystems:     map[string]string{},
+		Services:       map[string]ChannelService{},
 	}
+	handler.defaults = handler.newSessionState(nil)
 	return handler
 }
 
@@ -92,6 +155,12 @@ func (handler *DefaultSessionChanHandler) SetDefaults() {
 	handler.SetReqHandlerFunc(gosshd.ReqEnv, handler.HandleEnvReq)
 	handler.SetReqHandlerFunc(gosshd.ReqWinCh, handler.HandleWinChangeReq)
 	handler.SetReqHandlerFunc(gosshd.ReqExit, handler.HandleExit)
+	handler.SetReqHandlerFunc(gosshd.ReqSubsystem, handler.HandleSubsystemReq)
+	handler.SetReqHandlerFunc(gosshd.ReqKeepAlive, handler.HandleKeepAliveReq)
+	handler.SetReqHandlerFunc(gosshd.ReqEOW, handler.HandleEOWReq)
+	if sftpServer, err := LookupSftpServer(); err == nil {
+		handler.SetSubsystem(SftpSubsystem, sftpServer)
+	}
 }
 
 // RequestHandlerFunc 处理单个请求
@@ -101,44 +170,220 @@ type RequestHandlerFunc func(ctx gosshd.Context, request gosshd.Request, session
 // err 为处理函数返回的错误；rtype 为请求类型；wantReply 为是否需要回应客户端；payload 为请求附带的数据
 type ReqLogCallback func(err error, rtype string, wantReply bool, payload []byte, context gosshd.Context)
 
+// CommandAuditCallback 在 exec、shell 请求执行的命令结束后调用，用于审计；
+// command 为客户端请求执行的命令行，交互式 shell 为空字符串；exitCode 为退出码，因信号终止时为 128 加信号值，
+// 执行超时时为 ExecTimeoutStatus；duration 为命令执行的时间
+type CommandAuditCallback func(ctx gosshd.Context, command string, exitCode int, duration time.Duration)
+
+// CommandRewriter 在 exec 请求解析命令之前调用，返回实际执行的命令行，例如将 git-upload-pack '/repo' 中的虚拟路径映射为真实路径；
+// 返回 error 时拒绝该 exec 请求，可用于权限检查。CommandAuditCallback 收到的是改写后的命令行
+type CommandRewriter func(ctx gosshd.Context, cmd string) (string, error)
+
+// ShellFunc 在进程内实现的交互式 shell，例如菜单、REPL 等设备风格的界面，设置后 shell 请求将调用它而不是启动登陆程序或者用户的 shell；
+// ch 为 session 的 channel，pty 为客户端请求的 pty（未请求时为 nil），winch 传递之后的 window-change 请求；
+// ctx 被取消（例如客户端断开连接）时应当尽快返回，返回值将作为 exit-status 发送至客户端
+type ShellFunc func(ctx gosshd.Context, ch gosshd.Channel, pty *gosshd.PtyRequestMsg, winch <-chan *gosshd.PtyWindowChangeMsg) int
+
+// PtyRequestFilter 在 pty-req 请求被保存之前调用，可以检查并修改 msg，例如限制终端的最大大小；
+// 返回 error 时拒绝该 pty-req 请求，例如不支持的 TERM 类型，之后的 shell、exec 请求将以没有 pty 的方式执行
+type PtyRequestFilter func(ctx gosshd.Context, msg *gosshd.PtyRequestMsg) error
+
+// ExitStatusMapper 根据子进程的退出状态决定发送至客户端的结果：sig 不为空时发送 exit-signal 请求，否则以 code 发送 exit-status 请求；
+// 可用于改变信号终止时的行为，例如对不理解 exit-signal 的客户端总是发送 128 加信号值。为 nil 时使用 DefaultExitStatus
+type ExitStatusMapper func(state *os.ProcessState) (code int, sig gosshd.Signal)
+
 type CreateSessionCallback func(gosshd.Context, gosshd.Channel) gosshd.Channel
 
 // DefaultSessionChanHandler 一个处理 Channel 类型 SSH 通道的 ChannelHandler
 type DefaultSessionChanHandler struct {
-	sync.Mutex
+	sync.Mutex // 保护 ReqHandlers、Subsystems 与 Services；每个 session 的状态由 SessionState 自身的锁保护
+
 	winMsgBufSize int
-	ptyMsgBufSize int
 	sigMsgBufSize int
 
-	winchCh chan *gosshd.PtyWindowChangeMsg // window-change 请求队列
-	sigCh   chan *gosshd.SignalMsg          // signal 请求队列
-	ptyCh   chan *gosshd.PtyRequestMsg      // pty-req 请求队列
-	env     []string                        // 该 session 环境变量
+	defaults *SessionState // 默认状态，session 的环境变量以其环境变量作为初始值
 
 	copyBufSize int
-	ReqHandlers map[string]RequestHandlerFunc
+	ReqHandlers map[string]RequestHandlerFunc // 开始处理 session 之后应当通过 SetReqHandlerFunc、RemoveReqHandler 修改
 	ReqLogCallback
+	CommandAuditCallback
+	CommandRewriter
+	ShellFunc
+	ExitStatusMapper
+	PtyRequestFilter
+
+	Subsystems map[string]string         // subsystem 名称与对应执行的命令行
+	Services   map[string]ChannelService // subsystem 名称与对应的进程内服务，优先于 Subsystems
+
+	// 设置后 exec 请求将由该进程内服务处理，而不是以用户身份执行命令；为 nil 时执行命令
+	ExecService ChannelService
+
+	// 向客户端单次写入数据的最长时间，超时后将关闭该 session 并取消其处理过程；为 0 时不限制
+	WriteTimeout time.Duration
+
+	// session 的最长持续时间，从 channel 建立开始计时，无论是否活跃，到期后取消该 session，子进程将被挂断（先 SIGHUP 后 SIGKILL）；
+	// 为 0 时不限制
+	MaxSessionDuration time.Duration
+
+	// 每个 session 每个方向每秒传输的最大字节数，用于避免单个 session 占满带宽；为 0 时不限速
+	RateLimit int
+
+	// 大于 0 时，发送至客户端的输出先被缓存，最多延迟该时间后合并写入，减少高速输出时 SSH 数据包的数量；
+	// 会增加交互式 session 的延迟，为 0 时立即写入
+	OutputFlushDelay time.Duration
+
+	// 为 true 时，在 MaxSessionDuration 到期之前 SessionExpiryWarning 向客户端的标准错误发送警告
+	WarnBeforeSessionExpiry bool
+
+	// 用于记录发送至客户端的数据，为 nil 时不记录；无法打开记录时将关闭该 session
+	TranscriptStore TranscriptStore
+
+	// 为 true 时，authorized_keys 中 environment 选项设置的环境变量将被添加至 session 中，
+	// 与 OpenSSH 的 PermitUserEnvironment 相同，默认关闭
+	PermitUserEnvironment bool
+
+	// 返回交互式 shell 启动之前向客户端发送的登陆提示信息，例如 /etc/motd 的内容；为 nil 或返回空字符串时不发送，
+	// 只作用于分配了 pty 的 shell 请求，不作用于 exec 请求
+	MOTD func(ctx gosshd.Context) string
+
+	// 用于记录用户的登陆事件，并在分配了 pty 的 shell 启动之前显示上一次的登陆时间与主机，为 nil 时不记录；
+	// login 程序自身也会显示上次登陆信息，所以通常与为空的 LoginProgram 一起使用
+	LoginRecorder LoginRecorder
+
+	// 为 true 时，分配了 pty 的 shell 启动后向 utmp 与 wtmp 写入登陆记录，结束时写入登出记录，使 who、w、last 等工具可以看到该 session；
+	// 只支持 Linux，且需要写入 UtmpFile、WtmpFile 的权限；login 程序自身会写入记录，所以通常与为空的 LoginProgram 一起使用
+	UtmpAccounting bool
+
+	// 客户端断开连接时，先向子进程的进程组发送 SIGHUP，经过该时间后子进程仍未退出则发送 SIGKILL；
+	// 为 0 时使用 DefaultHangupGracePeriod
+	HangupGracePeriod time.Duration
+
+	// 为 false 时拒绝所有的 pty-req 请求，与 OpenSSH 的 PermitTTY no 相同，shell 请求将以非交互的方式执行用户的默认 shell；
+	// NewSessionHandler 创建的实例默认为 true
+	PermitTTY bool
+
+	// shell 请求执行的登陆程序及其参数，参数中的 %u 将被替换为用户名，默认为 DefaultLoginProgram；
+	// 为空时直接以用户身份启动其默认 shell
+	LoginProgram []string
+
+	// exec 请求执行命令的最长时间，超时后杀死子进程并发送退出码 ExecTimeoutStatus；为 0 时不限制
+	ExecTimeout time.Duration
+
+	// session 关闭后调用，无论 session 以何种方式结束（包括 Context 被取消）都只调用一次，
+	// 可用于释放 session 相关的资源，例如临时目录、数据库连接等；此时 ctx 已被取消，但仍可读取其中的值
+	OnChannelClose func(ctx gosshd.Context, chType string)
+
+	// 请求 payload 的最大字节数，超出时在解析之前拒绝该请求，例如过长的 env、exec 请求；
+	// 为 0 时不限制（ssh 包限制了单个数据包的大小）
+	MaxRequestPayload int
+
+	// 每个 session 环境变量的最大数量，超出后拒绝新的 env 请求；NewSessionHandler 创建的实例默认为 DefaultMaxEnvVars，
+	// 为 0 时不限制
+	MaxEnvVars int
+
+	// 允许客户端通过 env 请求设置的环境变量名称，与 OpenSSH 的 AcceptEnv 相同，支持 '*' 与 '?' 通配符，例如 "LANG"、"LC_*"；
+	// 为 nil 时接受所有的环境变量，不在列表中的环境变量将被拒绝
+	AcceptEnv []string
+
+	// 为 true 时以用户的身份执行命令，需要服务器以 root 身份运行；为 false 时命令以服务器进程自身的身份运行，
+	// 可用于开发、测试以及 rootless 容器等非 root 环境，此时通常需要将 LoginProgram 设为空，因为 login 程序同样需要 root 权限。
+	// NewSessionHandler 创建的实例默认为 true
+	DropPrivileges bool
+
+	// 为 true 时，未分配 pty 的 exec 请求的标准错误也写入 session 的标准输出，而不是 extended data（stderr）；
+	// 只用于不区分 stderr 的简单客户端，默认为 false
+	MergeStderr bool
 }
 
+// DefaultMaxEnvVars 每个 session 默认允许的环境变量最大数量
+const DefaultMaxEnvVars = 256
+
 var InterruptedErr = errors.New("interrupted by Context")
 
 var NotSessionTypeErr = errors.New("not session type channel")
 
+var RequestPayloadTooLargeErr = errors.New("request payload too large")
+
+var TooManyEnvVarsErr = errors.New("too many environment variables")
+
+var EnvNotAcceptedErr = errors.New("environment variable not accepted")
+
 // SetReqHandlerFunc 添加一个对应请求类型的处理函数
 func (handler *DefaultSessionChanHandler) SetReqHandlerFunc(reqtype string, f RequestHandlerFunc) {
+	handler.Lock()
+	defer handler.Unlock()
 	handler.ReqHandlers[reqtype] = f
 }
 
+// reqHandler 返回对应请求类型的处理函数
+func (handler *DefaultSessionChanHandler) reqHandler(reqtype string) (RequestHandlerFunc, bool) {
+	handler.Lock()
+	defer handler.Unlock()
+	f, ok := handler.ReqHandlers[reqtype]
+	return f, ok
+}
+
+// RemoveReqHandler 移除对应请求类型的处理函数，之后该类型的请求将被拒绝
+func (handler *DefaultSessionChanHandler) RemoveReqHandler(reqtype string) {
+	handler.Lock()
+	defer handler.Unlock()
+	delete(handler.ReqHandlers, reqtype)
+}
+
 // Start 接受客户端的 session channel 请求建立，并开始开启子协程的方式处理 requests；
-// 当所有请求处理完毕后或接收到一个 nil Request，将关闭该会话
+// 当所有请求处理完毕后或接收到一个 nil Request，将关闭该会话；
+// 每个 session 使用单独的 Context 进行处理，会话关闭时该 Context 将被取消
 func (handler *DefaultSessionChanHandler) Start(ctx gosshd.Context, c gosshd.NewChannel) error {
 	if c.ChannelType() != gosshd.SessionTypeChannel {
 		return NotSessionTypeErr
 	}
+	var channel gosshd.Channel
 	channel, requests, err := c.Accept()
 	if err != nil {
 		return err
 	}
+	ctx, cancel := gosshd.WithCancel(ctx)
+	if handler.OnChannelClose != nil {
+		defer handler.OnChannelClose(ctx, c.ChannelType())
+	}
+	defer cancel()
+
+	// 每个 session 拥有独立的请求队列与环境变量
+	env := handler.Env(nil)
+	// authorized_keys 中的环境变量先于客户端发送的环境变量
+	if handler.PermitUserEnvironment {
+		env = append(UserEnvironment(ctx.Permissions()), env...)
+	}
+	ctx.SetValue(sessionStateKey{}, handler.newSessionState(env))
+
+	if handler.WriteTimeout > 0 {
+		raw := channel
+		channel = NewWriteTimeoutChannel(raw, handler.WriteTimeout, func() {
+			cancel()
+			raw.Close()
+		})
+	}
+
+	channel = NewRateLimitedChannel(channel, handler.RateLimit)
+
+	if handler.OutputFlushDelay > 0 {
+		channel = NewBufferedChannel(channel, outputBufferSize, handler.OutputFlushDelay)
+	}
+
+	if handler.MaxSessionDuration > 0 {
+		stop := handler.limitSessionDuration(channel, cancel)
+		defer stop()
+	}
+
+	if handler.TranscriptStore != nil {
+		transcript, err := handler.TranscriptStore.Open(transcriptSessionID(ctx))
+		if err != nil {
+			channel.Close()
+			return err
+		}
+		defer transcript.Close()
+		channel = NewTranscriptChannel(channel, transcript)
+	}
 
 	for {
 		select {
@@ -150,7 +395,9 @@ func (handler *DefaultSessionChanHandler) Start(ctx gosshd.Context, c gosshd.New
 			if request == nil {
 				goto ret
 			}
-			go handler.ServeRequest(ctx, gosshd.Request{Request: request}, channel)
+			// pty-req 与 env 请求只修改 session 的状态，按顺序处理，保证之后的 shell、exec 请求可以看到其结果
+			inOrder := request.Type == gosshd.ReqPty || request.Type == gosshd.ReqEnv
+			handler.serveRequest(ctx, gosshd.Request{Request: request}, channel, !inOrder)
 		}
 	}
 ret:
@@ -158,16 +405,61 @@ ret:
 	return channel.Close()
 }
 
+// outputBufferSize OutputFlushDelay 大于 0 时输出缓存的大小，与 ssh 包单个数据包的最大载荷相同
+const outputBufferSize = 32 * 1024
+
+// SessionExpiryWarning MaxSessionDuration 到期之前发送警告的时间
+const SessionExpiryWarning = 60 * time.Second
+
+// limitSessionDuration 在 MaxSessionDuration 到期后调用 cancel，并根据 WarnBeforeSessionExpiry 提前发送警告；
+// 返回的函数用于在 session 结束时停止计时
+func (handler *DefaultSessionChanHandler) limitSessionDuration(channel gosshd.Channel, cancel context.CancelFunc) func() {
+	expire := time.AfterFunc(handler.MaxSessionDuration, cancel)
+	var warn *time.Timer
+	if handler.WarnBeforeSessionExpiry && handler.MaxSessionDuration > SessionExpiryWarning {
+		warn = time.AfterFunc(handler.MaxSessionDuration-SessionExpiryWarning, func() {
+			msg := fmt.Sprintf("\r\nsession will be terminated in %s\r\n", SessionExpiryWarning)
+			channel.Stderr().Write([]byte(msg))
+		})
+	}
+	return func() {
+		expire.Stop()
+		if warn != nil {
+			warn.Stop()
+		}
+	}
+}
+
 // ServeRequest 从注册的请求处理函数中找到对应请求类型的函数，并调用；
-// 处理函数返回的错误将被用于 handler 的 ReqLogCallback
+// 处理函数返回的错误将被用于 handler 的 ReqLogCallback；
+// 处理函数发生 panic 时，由 SSHServer 的 PanicCallback 记录，并关闭该 session；
+// payload 超过 MaxRequestPayload 的请求将被直接拒绝
 func (handler *DefaultSessionChanHandler) ServeRequest(ctx gosshd.Context, request gosshd.Request, session gosshd.Channel) {
-	if reqHandler, ok := handler.ReqHandlers[request.Type]; ok {
-		go func() {
+	handler.serveRequest(ctx, request, session, true)
+}
+
+// serveRequest async 为 true 时在新的协程中调用处理函数，否则等待处理函数返回
+func (handler *DefaultSessionChanHandler) serveRequest(ctx gosshd.Context, request gosshd.Request, session gosshd.Channel, async bool) {
+	if handler.MaxRequestPayload > 0 && len(request.Payload) > handler.MaxRequestPayload {
+		request.Reply(false, nil)
+		if handler.ReqLogCallback != nil {
+			handler.ReqLogCallback(RequestPayloadTooLargeErr, request.Type, request.WantReply, request.Payload, ctx)
+		}
+		return
+	}
+	if reqHandler, ok := handler.reqHandler(request.Type); ok {
+		serve := func() {
+			defer gosshd.RecoverPanic(ctx, func() { session.Close() })
 			err := reqHandler(ctx, request, session)
 			if handler.ReqLogCallback != nil {
 				handler.ReqLogCallback(err, request.Type, request.WantReply, request.Payload, ctx)
 			}
-		}()
+		}
+		if async {
+			go serve()
+		} else {
+			serve()
+		}
 	} else {
 		request.Reply(false, nil)
 		if handler.ReqLogCallback != nil {
@@ -181,17 +473,73 @@ func (handler *DefaultSessionChanHandler) HandleExit(ctx gosshd.Context, request
 	return handler.SendExitStatus(0, true, session)
 }
 
+// HandleKeepAliveReq 回复客户端的 keepalive@openssh.com 请求
+func (handler *DefaultSessionChanHandler) HandleKeepAliveReq(ctx gosshd.Context, request gosshd.Request, session gosshd.Channel) error {
+	return request.Reply(true, nil)
+}
+
+// HandleEOWReq 处理 eow@openssh.com 请求，客户端不再读取数据，所以向客户端发送 EOF，之后向 session 写入数据将返回错误
+func (handler *DefaultSessionChanHandler) HandleEOWReq(ctx gosshd.Context, request gosshd.Request, session gosshd.Channel) error {
+	request.Reply(true, nil)
+	return session.CloseWrite()
+}
+
+// HandleEnvReq 将客户端发送的环境变量添加至 session 中，同名的环境变量只保留最后设置的值；
+// 环境变量数量达到 MaxEnvVars 后拒绝新的环境变量
 func (handler *DefaultSessionChanHandler) HandleEnvReq(ctx gosshd.Context, request gosshd.Request, session gosshd.Channel) error {
-	var payload *gosshd.SetenvRequest
-	err := ssh.Unmarshal(request.Payload, &payload)
+	payload := &gosshd.SetenvRequest{}
+	err := ssh.Unmarshal(request.Payload, payload)
 	if err != nil {
+		request.Reply(false, nil)
 		return err
 	}
-	env := handler.Env()
-	handler.SetEnv(append(env, fmt.Sprintf("%s=%s", payload.Name, payload.Value)))
+	// 未被接受的环境变量需要回复 false，客户端可以据此提示用户
+	if !handler.acceptEnv(payload.Name) {
+		request.Reply(false, nil)
+		return EnvNotAcceptedErr
+	}
+	if !handler.setSessionEnv(ctx, payload.Name, payload.Value) {
+		request.Reply(false, nil)
+		return TooManyEnvVarsErr
+	}
 	return request.Reply(true, nil)
 }
 
+// acceptEnv 根据 AcceptEnv 判断是否接受客户端设置名称为 name 的环境变量
+func (handler *DefaultSessionChanHandler) acceptEnv(name string) bool {
+	if name == "" || strings.ContainsRune(name, '=') {
+		return false
+	}
+	if handler.AcceptEnv == nil {
+		return true
+	}
+	for _, pattern := range handler.AcceptEnv {
+		if ok, _ := filepath.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// setSessionEnv 设置 session 的环境变量，已存在时替换其值；数量超出 MaxEnvVars 时返回 false
+func (handler *DefaultSessionChanHandler) setSessionEnv(ctx gosshd.Context, name, value string) bool {
+	state := handler.Session(ctx)
+	state.Lock()
+	defer state.Unlock()
+	prefix := name + "="
+	for i, kv := range state.env {
+		if strings.HasPrefix(kv, prefix) {
+			state.env[i] = prefix + value
+			return true
+		}
+	}
+	if handler.MaxEnvVars > 0 && len(state.env) >= handler.MaxEnvVars {
+		return false
+	}
+	state.env = append(state.env, prefix+value)
+	return true
+}
+
 // HandleSignalReq 解析客户端发送的窗口变换消息队列，并将其传入 session 窗口消息队列中
 // 根据 RFC 4254 6.9. signal 类型请求不需要回复
 func (handler *DefaultSessionChanHandler) HandleSignalReq(ctx gosshd.Context, request gosshd.Request, session gosshd.Channel) error {
@@ -199,7 +547,7 @@ func (handler *DefaultSessionChanHandler) HandleSignalReq(ctx gosshd.Context, re
 	if err := ssh.Unmarshal(request.Payload, sigMsg); err != nil {
 		return err
 	}
-	handler.PutSignalMsg(sigMsg)
+	handler.PutSignalMsg(ctx, sigMsg)
 	return request.Reply(true, nil)
 }
 
@@ -210,33 +558,173 @@ func (handler *DefaultSessionChanHandler) HandleWinChangeReq(ctx gosshd.Context,
 	if err := ssh.Unmarshal(request.Payload, winMsg); err != nil {
 		return err
 	}
-	handler.PutWinchMsg(winMsg)
+	handler.PutWinchMsg(ctx, winMsg)
 	request.Reply(true, nil)
 	return nil
 }
 
-// HandlePtyReq 解析 pty-req 请求，将信息存入 session 缓存队列中
+// HandlePtyReq 解析 pty-req 请求，经过 PtyRequestFilter 检查后保存至 session 的状态中，由之后的 shell、exec 请求使用
 func (handler *DefaultSessionChanHandler) HandlePtyReq(ctx gosshd.Context, request gosshd.Request, session gosshd.Channel) error {
+	if !handler.PermitTTY {
+		return request.Reply(false, nil)
+	}
 	ptyMsg := &gosshd.PtyRequestMsg{}
 	if err := ssh.Unmarshal(request.Payload, ptyMsg); err != nil {
-
+		request.Reply(false, nil)
 		return err
 	}
+	if handler.PtyRequestFilter != nil {
+		if err := handler.PtyRequestFilter(ctx, ptyMsg); err != nil {
+			request.Reply(false, nil)
+			return err
+		}
+	}
 	err := request.Reply(true, nil)
 	if err != nil {
 		return err
 	}
-	handler.PutPtyMsg(ptyMsg)
+	handler.PutPtyMsg(ctx, ptyMsg)
 	return nil
 }
 
-// HandleShellReq login -f 登陆用户，子进程打开错误或者处理完毕后 session 将被关闭；
+// DefaultPath 执行命令时默认的 PATH 环境变量
+const DefaultPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// connectionEnv 返回与 OpenSSH 相同的 SSH_CONNECTION 与 SSH_CLIENT 环境变量，地址未知时返回 nil
+func connectionEnv(ctx gosshd.Context) []string {
+	raddr, laddr := ctx.RemoteAddr(), ctx.LocalAddr()
+	if raddr == nil || laddr == nil {
+		return nil
+	}
+	chost, cport, err1 := net.SplitHostPort(raddr.String())
+	shost, sport, err2 := net.SplitHostPort(laddr.String())
+	if err1 != nil || err2 != nil {
+		return nil
+	}
+	return []string{
+		fmt.Sprintf("SSH_CONNECTION=%s %s %s %s", chost, cport, shost, sport),
+		fmt.Sprintf("SSH_CLIENT=%s %s %s", chost, cport, sport),
+	}
+}
+
+// commandEnv 返回执行命令时的环境变量：先是与登陆 shell 相同的 PATH、HOME、USER、LOGNAME 以及 SHELL，
+// 与 OpenSSH 相同的 SSH_CONNECTION 与 SSH_CLIENT，之后是 session 的环境变量，同名时后者生效
+func (handler *DefaultSessionChanHandler) commandEnv(ctx gosshd.Context, user *gosshd.User) []string {
+	shell := user.Shell
+	if shell == "" {
+		shell = DefaultUserShell
+	}
+	env := []string{
+		"PATH=" + DefaultPath,
+		"HOME=" + user.HomeDir,
+		"USER=" + user.UserName,
+		"LOGNAME=" + user.UserName,
+		"SHELL=" + shell,
+	}
+	env = append(env, connectionEnv(ctx)...)
+	return append(env, handler.Env(ctx)...)
+}
+
+// UserNamePattern shell 请求允许的用户名，默认只允许小写字母、数字、下划线以及 -，且不能以数字或 - 开头；
+// LookupUserCallback 允许其它形式的用户名时可以修改该值，但需要确保其不会被登陆程序当作选项
+var UserNamePattern = regexp.MustCompile(`^[a-z_][a-z0-9_-]*$`)
+
+var InvalidUserNameErr = errors.New("invalid user name")
+
+// DefaultLoginProgram shell 请求默认执行的登陆程序，%u 为用户名
+var DefaultLoginProgram = []string{"login", "-f", "%u"}
+
+// createCmd 通过 CreateCmdWithUser 创建子进程，DropPrivileges 为 false 时不切换用户身份
+func (handler *DefaultSessionChanHandler) createCmd(user *gosshd.User, name string, args ...string) (*exec.Cmd, error) {
+	if !handler.DropPrivileges && user != nil {
+		u := *user
+		u.Uid = ""
+		user = &u
+	}
+	return CreateCmdWithUser(user, name, args...)
+}
+
+// loginCmd 根据 LoginProgram 生成 shell 请求执行的命令；LoginProgram 为空时以用户身份启动其默认 shell，
+// 与 login 一样，argv[0] 以 "-" 开头使其作为登陆 shell 运行
+func (handler *DefaultSessionChanHandler) loginCmd(ctx gosshd.Context, user *gosshd.User, term string) (*exec.Cmd, error) {
+	if len(handler.LoginProgram) == 0 {
+		shell := user.Shell
+		if shell == "" {
+			shell = DefaultUserShell
+		}
+		cmd, err := handler.createCmd(user, shell)
+		if err != nil {
+			return nil, err
+		}
+		cmd.Args[0] = "-" + filepath.Base(shell)
+		cmd.Dir = user.HomeDir
+		cmd.Env = append(handler.commandEnv(ctx, user), "TERM="+term)
+		return cmd, nil
+	}
+	args := make([]string, len(handler.LoginProgram))
+	for i, arg := range handler.LoginProgram {
+		args[i] = strings.ReplaceAll(arg, "%u", user.UserName)
+	}
+	cmd := exec.Command(args[0], args[1:]...)
+	// 不继承服务器进程的环境变量，只传递客户端请求的 TERM、SSH_CONNECTION、SSH_CLIENT 与区域设置
+	cmd.Env = append([]string{"TERM=" + term}, connectionEnv(ctx)...)
+	cmd.Env = append(cmd.Env, handler.localeEnv(ctx)...)
+	return cmd, nil
+}
+
+// LocaleEnv 传递给登陆程序的 session 环境变量，支持 '*' 与 '?' 通配符；
+// 注意 login 会清除 TERM 以外的环境变量，需要在 LoginProgram 中使用 -p 参数才能保留
+var LocaleEnv = []string{"LANG", "LANGUAGE", "LC_*"}
+
+// localeEnv 返回 session 环境变量中名称与 LocaleEnv 匹配的部分
+func (handler *DefaultSessionChanHandler) localeEnv(ctx gosshd.Context) []string {
+	var env []string
+	for _, kv := range handler.Env(ctx) {
+		name := kv
+		if i := strings.IndexByte(kv, '='); i >= 0 {
+			name = kv[:i]
+		}
+		for _, pattern := range LocaleEnv {
+			if ok, _ := filepath.Match(pattern, name); ok {
+				env = append(env, kv)
+				break
+			}
+		}
+	}
+	return env
+}
+
+// HandleShellReq 通过 LoginProgram（默认为 login -f）登陆用户，设置了 ShellFunc 时调用 ShellFunc；
+// 用户名不合法、无法创建登陆程序或者分配 pty 时拒绝该请求；接受请求之后子进程启动失败时发送 exit-status 1，处理完毕后 session 将被关闭；
 // todo 没有对 RFC 4254 8. 规定的 Encoding of Terminal Modes 进行处理
 func (handler *DefaultSessionChanHandler) HandleShellReq(ctx gosshd.Context, request gosshd.Request, session gosshd.Channel) error {
-	request.Reply(true, nil)
+	if handler.ShellFunc != nil {
+		request.Reply(true, nil)
+		code := handler.ShellFunc(ctx, session, handler.PtyMsg(ctx), handler.WinchMsg(ctx))
+		return handler.SendExitStatus(code, true, session)
+	}
 	user := ctx.User()
-	ptyMsg := <-handler.PtyMsg()
-	cmd := exec.Command("login", "-f", user.UserName) // fixme 会不会有 RCE 取决于 LookupUser 回调函数生成的 UserName
+	// 用户名将作为登陆程序的参数，以 - 开头等形式的用户名可能被当作选项，所以拒绝不符合 UserNamePattern 的用户名
+	if user == nil || !UserNamePattern.MatchString(user.UserName) {
+		request.Reply(false, nil)
+		session.Close()
+		return InvalidUserNameErr
+	}
+	// 不允许分配 pty 或者客户端没有请求 pty 时，以非交互的方式执行用户的默认 shell，从 session 读取命令
+	ptyMsg := handler.PtyMsg(ctx)
+	if !handler.PermitTTY || ptyMsg == nil {
+		shell := user.Shell
+		if shell == "" {
+			shell = DefaultUserShell
+		}
+		return handler.execCmd(ctx, request, shell, session)
+	}
+	// 创建登陆程序与分配 pty 失败时拒绝该请求，之后的错误通过 exit-status 1 告知客户端并关闭 session
+	cmd, err := handler.loginCmd(ctx, user, ptyMsg.Term)
+	if err != nil {
+		request.Reply(false, nil)
+		return err
+	}
 	// 当接收到 context 的 cancelFunc 时，取消子进程的执行
 	var wbuf []byte = nil
 	var rbuf []byte = nil
@@ -245,15 +733,8 @@ func (handler *DefaultSessionChanHandler) HandleShellReq(ctx gosshd.Context, req
 		rbuf = make([]byte, handler.copyBufSize)
 	}
 
-	// 应用 term 环境变量
-	//cmd.Env = append(cmd.Env, fmt.Sprintf("TERM=%s", ptyMsg.Term))
-
-	pty, tty, err := StartPtyWithSize(cmd, &Winsize{
-		Cols: uint16(ptyMsg.Columns),
-		Rows: uint16(ptyMsg.Rows),
-		X:    uint16(ptyMsg.Width),
-		Y:    uint16(ptyMsg.Height),
-	})
+	// StartPtyWithSize 只分配 pty 并绑定子进程的输入输出，子进程由之后的 cmd.Start 启动，所以此时仍可以添加 SSH_TTY
+	pty, tty, err := StartPtyWithSize(cmd, (&Winsize{}).FromPtyRequest(ptyMsg))
 	if pty != nil {
 		defer pty.Close()
 	}
@@ -261,79 +742,305 @@ func (handler *DefaultSessionChanHandler) HandleShellReq(ctx gosshd.Context, req
 		defer tty.Close()
 	}
 	if err != nil {
+		request.Reply(false, nil)
 		return err
 	}
+	cmd.Env = append(cmd.Env, "SSH_TTY="+tty.Name())
+	request.Reply(true, nil)
 
-	if err := cmd.Start(); err != nil {
-		session.Close()
+	// 在子进程的输出之前发送上次登陆信息与登陆提示信息
+	if err := handler.recordLogin(ctx, session); err != nil {
+		handler.SendExitStatus(1, true, session)
 		return err
 	}
-	exitCtx, cancel := context.WithCancel(ctx)
-	go CopyBufferWithContext(session, pty, wbuf, exitCtx)
-	go CopyBufferWithContext(pty, session, rbuf, exitCtx)
-	// 接受窗口改变消息，并应用于 pty
-	go func() {
-		win := &Winsize{}
-		for {
-			select {
-			case winChange := <-handler.WinchMsg():
-				win.Rows = uint16(winChange.Rows)
-				win.Cols = uint16(winChange.Columns)
-				win.X = uint16(winChange.Width)
-				win.Y = uint16(winChange.Height)
-				Setsize(pty, win)
-			case <-exitCtx.Done():
-				return
+	if handler.MOTD != nil {
+		if motd := handler.MOTD(ctx); motd != "" {
+			if _, err := session.Write([]byte(toCRLF(motd))); err != nil {
+				handler.SendExitStatus(1, true, session)
+				return err
 			}
 		}
-	}()
+	}
 
-	// fixme 当 session 取消信号来临时，是否要关闭子进程
+	start := time.Now()
+	if err := cmd.Start(); err != nil {
+		handler.SendExitStatus(1, true, session)
+		return err
+	}
+	if handler.UtmpAccounting {
+		logout := utmpLogin(tty.Name(), user.UserName, ctx.RemoteHost(), ctx.RemoteAddr(), cmd.Process.Pid)
+		defer logout()
+	}
+	// 子进程已经持有 tty，关闭之后，所有子进程退出时读取 pty 将返回错误，输出的复制随之结束
+	tty.Close()
+	exitCtx, cancel := context.WithCancel(ctx)
+	// 子进程退出后，pty 中剩余的输出需要全部发送至客户端
+	output := make(chan struct{})
 	go func() {
-		select {
-		case <-exitCtx.Done():
-			cmd.Process.Kill()
-		}
+		defer close(output)
+		CopyBufferWithContext(session, pty, wbuf, ctx)
 	}()
+	go CopyBufferWithContext(pty, session, rbuf, exitCtx)
+	// 接受窗口改变消息，并应用于 pty；关闭 pty 之前需要等待其退出
+	defer handler.startWindowChanges(ctx, exitCtx, pty)()
+
+	// 客户端断开连接时挂断子进程
+	exited := make(chan struct{})
+	go handler.hangup(ctx, cmd, exited)
 
 	// 接受 Signal 消息，并应用于 Process
-	go func() {
-		for {
-			select {
-			case signal := <-handler.SignalMsg():
-				cmd.Process.Signal(signal.Signal)
-			case <-exitCtx.Done():
-				return
-			}
-		}
-	}()
+	go handler.forwardSignals(ctx, exitCtx, cmd)
 
 	err = cmd.Wait()
+	close(exited)
+	handler.auditCommand(ctx, "", cmd.ProcessState, false, time.Since(start))
+	// 后台进程可能仍然持有 tty，所以最多等待 ptyDrainTimeout
+	select {
+	case <-output:
+	case <-time.After(ptyDrainTimeout):
+	}
 	cancel()
-	return handler.SendExitStatus(cmd.ProcessState.ExitCode(), true, session)
+	return handler.SendExitState(cmd.ProcessState, session)
 }
 
-// HandleExecReq 处理 exec 请求，处理完毕后 session 将被关闭
+// HandleExecReq 处理 exec 请求，设置了 CommandRewriter 时执行改写后的命令，设置了 ExecService 时交由其处理；处理完毕后 session 将被关闭
 func (handler *DefaultSessionChanHandler) HandleExecReq(ctx gosshd.Context, request gosshd.Request, session gosshd.Channel) error {
 	cmdMsg := &gosshd.ExecMsg{}
 	if err := ssh.Unmarshal(request.Payload, cmdMsg); err != nil {
 		request.Reply(false, nil)
 		return err
 	}
-	return handler.execCmd(ctx, request, cmdMsg.Command, session)
+	command := cmdMsg.Command
+	if handler.CommandRewriter != nil {
+		rewritten, err := handler.CommandRewriter(ctx, command)
+		if err != nil {
+			request.Reply(false, nil)
+			return err
+		}
+		command = rewritten
+	}
+	if handler.ExecService != nil {
+		return handler.serveService(ctx, request, command, false, handler.ExecService, session)
+	}
+	return handler.execCmd(ctx, request, command, session)
+}
+
+// SetSubsystem 设置 subsystem 对应执行的命令行，例如 "sftp" 对应 "/usr/lib/openssh/sftp-server"
+func (handler *DefaultSessionChanHandler) SetSubsystem(name, cmdline string) {
+	handler.Lock()
+	defer handler.Unlock()
+	if handler.Subsystems == nil {
+		handler.Subsystems = map[string]string{}
+	}
+	handler.Subsystems[name] = cmdline
+}
+
+// subsystem 在持有锁时查找 subsystem 对应的命令行
+func (handler *DefaultSessionChanHandler) subsystem(name string) (string, bool) {
+	handler.Lock()
+	defer handler.Unlock()
+	cmdline, ok := handler.Subsystems[name]
+	return cmdline, ok
+}
+
+// HandleSubsystemReq 处理 subsystem 请求，调用 subsystem 对应的进程内服务，或者以用户身份执行对应的命令，处理完毕后 session 将被关闭；
+// 未设置的 subsystem 将被拒绝
+func (handler *DefaultSessionChanHandler) HandleSubsystemReq(ctx gosshd.Context, request gosshd.Request, session gosshd.Channel) error {
+	msg := &gosshd.SubsystemRequestMsg{}
+	if err := ssh.Unmarshal(request.Payload, msg); err != nil {
+		request.Reply(false, nil)
+		return err
+	}
+	if service, ok := handler.service(msg.Subsystem); ok {
+		return handler.serveService(ctx, request, msg.Subsystem, true, service, session)
+	}
+	cmdline, ok := handler.subsystem(msg.Subsystem)
+	if !ok {
+		request.Reply(false, nil)
+		return fmt.Errorf("unknown subsystem '%s'", msg.Subsystem)
+	}
+	return handler.execCmd(ctx, request, cmdline, session)
 }
 
-// SendExitStatus 发送 exit-status 请求，但 close 为 true 时，会关闭 BasicSession，
-// 当 close 为 false 时，返回请求发送时出现的错误；否则返回关闭 session 时的发送的错误
+// SendExitStatus 发送 exit-status 请求，但 close 为 true 时，会关闭 session，
+// 当 close 为 false 时，返回请求发送时出现的错误；否则返回关闭 session 时的发送的错误；
+// code 为负数时（例如 ExitCode 对未正常退出的进程返回 -1）发送 UnknownExitStatus，而不是转换为 uint32 后的巨大数值
 func (handler *DefaultSessionChanHandler) SendExitStatus(code int, close bool, session gosshd.Channel) error {
-	status := struct{ Status uint32 }{uint32(code)}
-	_, err := session.SendRequest(gosshd.ExitStatus, false, ssh.Marshal(&status))
-	if err != nil && !close {
+	if code < 0 {
+		code = UnknownExitStatus
+	}
+	err := gosshd.SendExitStatus(session, uint32(code))
+	if !close {
 		return err
 	}
 	return session.Close()
 }
 
+// UnknownExitStatus 无法得到子进程退出码时发送的 exit-status，与 ssh 客户端自身出错时的退出码相同
+const UnknownExitStatus = 255
+
+// SendExitState 根据子进程的退出状态发送 exit-status 或者 exit-signal 请求，由 ExitStatusMapper 决定；之后关闭 session
+func (handler *DefaultSessionChanHandler) SendExitState(state *os.ProcessState, session gosshd.Channel) error {
+	mapper := handler.ExitStatusMapper
+	if mapper == nil {
+		mapper = DefaultExitStatus
+	}
+	code, sig := mapper(state)
+	if sig != "" {
+		status, _ := state.Sys().(syscall.WaitStatus)
+		gosshd.SendExitSignal(session, sig, status.CoreDump(), "")
+		return session.Close()
+	}
+	return handler.SendExitStatus(code, true, session)
+}
+
+// DefaultExitStatus 默认的 ExitStatusMapper：子进程因 RFC 4254 中定义的信号终止时返回该信号，
+// 因其他信号终止时与 shell 一样返回 128 加信号值，否则返回进程的退出码
+func DefaultExitStatus(state *os.ProcessState) (int, gosshd.Signal) {
+	if status, ok := state.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		if sig, ok := signalName(status.Signal()); ok {
+			return 128 + int(status.Signal()), sig
+		}
+		return 128 + int(status.Signal()), ""
+	}
+	return state.ExitCode(), ""
+}
+
+// DefaultHangupGracePeriod 客户端断开连接后，发送 SIGHUP 与 SIGKILL 之间默认的等待时间
+const DefaultHangupGracePeriod = 2 * time.Second
+
+// hangup 在 ctx 被取消（例如客户端断开连接）而子进程仍未退出时，与 OpenSSH 一样先发送 SIGHUP，使 shell 及其作业可以清理退出，
+// 经过 HangupGracePeriod 之后仍未退出则发送 SIGKILL；exited 应在 cmd.Wait 返回后关闭
+func (handler *DefaultSessionChanHandler) hangup(ctx context.Context, cmd *exec.Cmd, exited <-chan struct{}) {
+	select {
+	case <-exited:
+		return
+	case <-ctx.Done():
+	}
+	signalProcessGroup(cmd, syscall.SIGHUP)
+	grace := handler.HangupGracePeriod
+	if grace <= 0 {
+		grace = DefaultHangupGracePeriod
+	}
+	timer := time.NewTimer(grace)
+	defer timer.Stop()
+	select {
+	case <-exited:
+	case <-timer.C:
+		signalProcessGroup(cmd, syscall.SIGKILL)
+	}
+}
+
+// signalProcessGroup 向以子进程为组长的进程组发送信号，使其后台作业、管道中的其它进程等不会成为孤儿进程；
+// 子进程在 pty 下通过 Setsid，否则通过 Setpgid 成为进程组组长；进程组不存在时只向子进程发送
+func signalProcessGroup(cmd *exec.Cmd, sig syscall.Signal) error {
+	if err := syscall.Kill(-cmd.Process.Pid, sig); err == nil {
+		return nil
+	}
+	return cmd.Process.Signal(sig)
+}
+
+// windowChangeDelay 合并 window-change 消息的时间间隔，拖动调整终端大小时客户端每秒可能发送数十个 window-change 消息
+const windowChangeDelay = 10 * time.Millisecond
+
+// startWindowChanges 在新的协程中调用 applyWindowChanges，返回的函数用于停止该协程并等待其退出
+func (handler *DefaultSessionChanHandler) startWindowChanges(ctx gosshd.Context, exitCtx context.Context, pty *os.File) func() {
+	winchCtx, cancel := context.WithCancel(exitCtx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		handler.applyWindowChanges(ctx, winchCtx, pty)
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+// applyWindowChanges 接受 session 的 window-change 消息并设置 pty 的大小，直到 exitCtx 结束；
+// 收到消息后等待 windowChangeDelay，期间到达的消息只保留最新的一个，避免频繁调用 Setsize
+func (handler *DefaultSessionChanHandler) applyWindowChanges(ctx gosshd.Context, exitCtx context.Context, pty *os.File) {
+	var latest *gosshd.PtyWindowChangeMsg
+	var timer <-chan time.Time
+	for {
+		select {
+		case winChange := <-handler.WinchMsg(ctx):
+			latest = winChange
+			if timer == nil {
+				timer = time.After(windowChangeDelay)
+			}
+		case <-timer:
+			timer = nil
+			ApplyWindowChange(pty, latest)
+		case <-exitCtx.Done():
+			return
+		}
+	}
+}
+
+// forwardSignals 将 session 收到的 signal 请求转换为对应的信号，发送至子进程的进程组，
+// 使管道中的所有进程都能收到例如 INT 等信号；exitCtx 被取消时返回
+func (handler *DefaultSessionChanHandler) forwardSignals(ctx gosshd.Context, exitCtx context.Context, cmd *exec.Cmd) {
+	for {
+		select {
+		case signal := <-handler.SignalMsg(ctx):
+			if sig, ok := gosshd.Signals[signal.Signal]; ok {
+				signalProcessGroup(cmd, syscall.Signal(sig))
+			}
+		case <-exitCtx.Done():
+			return
+		}
+	}
+}
+
+// ExecTimeoutStatus exec 请求执行超时时发送的退出码，与 timeout(1) 相同
+const ExecTimeoutStatus = 124
+
+// startExecTimer 设置了 ExecTimeout 且 request 为 exec 请求时（不包括 subsystem），在超时后杀死 cmd 的进程；
+// 应在 cmd.Wait 返回之后调用返回的函数，停止计时并报告进程是否因超时而被杀死
+func (handler *DefaultSessionChanHandler) startExecTimer(ctx context.Context, request gosshd.Request, cmd *exec.Cmd) func() bool {
+	if handler.ExecTimeout <= 0 || request.Type != gosshd.ReqExec {
+		return func() bool { return false }
+	}
+	timeoutCtx, cancel := context.WithTimeout(ctx, handler.ExecTimeout)
+	killed := make(chan bool, 1)
+	go func() {
+		<-timeoutCtx.Done()
+		killed <- timeoutCtx.Err() == context.DeadlineExceeded && signalProcessGroup(cmd, syscall.SIGKILL) == nil
+	}()
+	return func() bool {
+		cancel()
+		return <-killed
+	}
+}
+
+// auditCommand 设置了 CommandAuditCallback 时，记录执行完毕的命令及其退出码
+func (handler *DefaultSessionChanHandler) auditCommand(ctx gosshd.Context, command string, state *os.ProcessState, timedOut bool, duration time.Duration) {
+	if handler.CommandAuditCallback == nil {
+		return
+	}
+	code := -1
+	if timedOut {
+		code = ExecTimeoutStatus
+	} else if state != nil {
+		code = state.ExitCode()
+		if status, ok := state.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			code = 128 + int(status.Signal())
+		}
+	}
+	handler.CommandAuditCallback(ctx, command, code, duration)
+}
+
+// signalName 返回信号在 RFC 4254 中的名称
+func signalName(sig syscall.Signal) (gosshd.Signal, bool) {
+	for name, num := range gosshd.Signals {
+		if num == int(sig) {
+			return name, true
+		}
+	}
+	return "", false
+}
+
 func (handler *DefaultSessionChanHandler) execCmd(ctx gosshd.Context, request gosshd.Request, cmdline string, session gosshd.Channel) error {
 	words, err := shlex.Split(cmdline, true)
 	if err != nil {
@@ -343,9 +1050,9 @@ func (handler *DefaultSessionChanHandler) execCmd(ctx gosshd.Context, request go
 	var cmd *exec.Cmd
 
 	if len(words) == 1 {
-		cmd, err = CreateCmdWithUser(ctx.User(), words[0])
+		cmd, err = handler.createCmd(ctx.User(), words[0])
 	} else if len(words) >= 2 {
-		cmd, err = CreateCmdWithUser(ctx.User(), words[0], words[1:]...)
+		cmd, err = handler.createCmd(ctx.User(), words[0], words[1:]...)
 	} else {
 		request.Reply(false, nil)
 		return err
@@ -357,63 +1064,96 @@ func (handler *DefaultSessionChanHandler) execCmd(ctx gosshd.Context, request go
 	}
 
 	request.Reply(true, nil)
-	cmd.Env = handler.Env()
+	cmd.Env = handler.commandEnv(ctx, ctx.User())
 	cmd.Dir = ctx.User().HomeDir
 
 	// 如果客户端之前请求了伪终端
-	if len(handler.PtyMsg()) != 0 {
-		select {
-		case ptyMsg := <-handler.PtyMsg():
-			return handler.execCmdWithPty(ctx, request, cmd, ptyMsg, session)
-		case <-ctx.Done(): // 如果分配到 pty 之前就已经关闭
-			return nil
-		}
+	if ptyMsg := handler.PtyMsg(ctx); ptyMsg != nil {
+		return handler.execCmdWithPty(ctx, request, cmdline, cmd, ptyMsg, session)
 	} else {
+		// 使子进程成为进程组组长，以便结束时一并结束其创建的进程
+		if cmd.SysProcAttr == nil {
+			cmd.SysProcAttr = &syscall.SysProcAttr{}
+		}
+		cmd.SysProcAttr.Setpgid = true
 		stdOut, err := cmd.StdoutPipe()
+		if err != nil {
+			request.Reply(false, nil)
+			return err
+		}
 		stdErr, err := cmd.StderrPipe()
+		if err != nil {
+			request.Reply(false, nil)
+			return err
+		}
 		stdIn, err := cmd.StdinPipe()
 		if err != nil {
 			request.Reply(false, nil)
 			return err
 		}
-		var stdOutWBuf []byte = nil
-		var stdInRBuf []byte = nil
-		var errWBuf []byte = nil
+		var stdInBuf []byte = nil
+		var stdOutBuf []byte = nil
+		var stdErrBuf []byte = nil
 
 		if handler.copyBufSize > 0 {
-			stdInRBuf = make([]byte, handler.copyBufSize)
-			stdOutWBuf = make([]byte, handler.copyBufSize)
-			errWBuf = make([]byte, handler.copyBufSize)
+			stdInBuf = make([]byte, handler.copyBufSize)
+			stdOutBuf = make([]byte, handler.copyBufSize)
+			stdErrBuf = make([]byte, handler.copyBufSize)
 		}
 		exitCtx, cancel := context.WithCancel(ctx)
-		go CopyBufferWithContext(stdIn, session, stdInRBuf, exitCtx)
-		go CopyBufferWithContext(session.Stderr(), stdErr, stdOutWBuf, exitCtx)
-		go CopyBufferWithContext(session, stdOut, errWBuf, exitCtx)
+		// 客户端发送 EOF 时关闭子进程的标准输入，例如 echo data | ssh host 'cat > file'
+		go func() {
+			CopyBufferWithContext(stdIn, session, stdInBuf, exitCtx)
+			stdIn.Close()
+		}()
+		// 子进程的输出需要全部发送至客户端之后，才能发送 exit-status 并关闭 channel
+		var stdErrDst io.Writer = session.Stderr()
+		if handler.MergeStderr {
+			stdErrDst = session
+		}
+		var outputs sync.WaitGroup
+		outputs.Add(2)
+		go func() {
+			defer outputs.Done()
+			CopyBufferWithContext(stdErrDst, stdErr, stdErrBuf, ctx)
+			stdErr.Close() // 客户端已经断开时，使子进程不会阻塞在写入上
+		}()
+		go func() {
+			defer outputs.Done()
+			CopyBufferWithContext(session, stdOut, stdOutBuf, ctx)
+			stdOut.Close()
+		}()
+		start := time.Now()
 		if err = cmd.Start(); err != nil {
 			cancel()
 			session.Close()
 			return err
 		}
+		timedOut := handler.startExecTimer(ctx, request, cmd)
+		// 客户端断开连接时挂断子进程
+		exited := make(chan struct{})
+		go handler.hangup(ctx, cmd, exited)
 		// 接受 Signal 消息，并应用于 Process
-		go func() {
-			for {
-				select {
-				case signal := <-handler.SignalMsg():
-					sig := gosshd.Signals[signal.Signal]
-					cmd.Process.Signal(syscall.Signal(sig))
-				case <-exitCtx.Done():
-					return
-				}
-			}
-		}()
+		go handler.forwardSignals(ctx, exitCtx, cmd)
+		// cmd.Wait 会关闭输出管道，所以必须等待输出读取完毕后再调用
+		outputs.Wait()
+		// 输出已经全部发送，向客户端发送 EOF，之后再发送退出状态并关闭 session
+		session.CloseWrite()
 		_ = cmd.Wait()
+		close(exited)
+		duration := time.Since(start)
 		cancel()
-		return handler.SendExitStatus(cmd.ProcessState.ExitCode(), true, session)
+		killed := timedOut()
+		handler.auditCommand(ctx, cmdline, cmd.ProcessState, killed, duration)
+		if killed {
+			return handler.SendExitStatus(ExecTimeoutStatus, true, session)
+		}
+		return handler.SendExitState(cmd.ProcessState, session)
 	}
 }
 
 // 分配一个 Pty 至 cmd ，并将输入输出绑定到 session 中，最终 session 将被关闭
-func (handler *DefaultSessionChanHandler) execCmdWithPty(ctx gosshd.Context, request gosshd.Request, cmd *exec.Cmd, msg *gosshd.PtyRequestMsg, session gosshd.Channel) error {
+func (handler *DefaultSessionChanHandler) execCmdWithPty(ctx gosshd.Context, request gosshd.Request, cmdline string, cmd *exec.Cmd, msg *gosshd.PtyRequestMsg, session gosshd.Channel) error {
 	var wbuf []byte = nil
 	var rbuf []byte = nil
 	if handler.copyBufSize > 0 {
@@ -422,13 +1162,8 @@ func (handler *DefaultSessionChanHandler) execCmdWithPty(ctx gosshd.Context, req
 	}
 	// 应用 term 环境变量
 	cmd.Env = append(cmd.Env, fmt.Sprintf("TERM=%s", msg.Term))
-	pty, tty, err := StartPtyWithSize(cmd, &Winsize{
-		Cols: uint16(msg.Columns),
-		Rows: uint16(msg.Rows),
-		X:    uint16(msg.Width),
-		Y:    uint16(msg.Height),
-	})
-
+	// 分配 pty 之后、启动子进程之前添加 SSH_TTY
+	pty, tty, err := StartPtyWithSize(cmd, (&Winsize{}).FromPtyRequest(msg))
 	if pty != nil {
 		defer pty.Close()
 	}
@@ -438,55 +1173,51 @@ func (handler *DefaultSessionChanHandler) execCmdWithPty(ctx gosshd.Context, req
 	if err != nil {
 		return err
 	}
+	cmd.Env = append(cmd.Env, "SSH_TTY="+tty.Name())
 	exitCtx, cancel := context.WithCancel(ctx)
-	go CopyBufferWithContext(session, pty, wbuf, exitCtx)
-	go CopyBufferWithContext(pty, session, rbuf, exitCtx)
-	// 接受窗口改变消息，并应用于 pty
-	go func() {
-		win := &Winsize{}
-		for {
-			select {
-			case winChange := <-handler.WinchMsg():
-				win.Rows = uint16(winChange.Rows)
-				win.Cols = uint16(winChange.Columns)
-				win.X = uint16(winChange.Width)
-				win.Y = uint16(winChange.Height)
-				Setsize(pty, win)
-			case <-exitCtx.Done():
-				return
-			}
-		}
-	}()
-
-	// fixme 当 session 取消信号来临时，是否要关闭子进程
+	// 子进程退出后，pty 中剩余的输出需要全部发送至客户端
+	output := make(chan struct{})
 	go func() {
-		select {
-		case <-ctx.Done():
-			cmd.Process.Kill()
-		}
-	}()
-
-	// 接受 Signal 消息，并应用于 Process
-	go func() {
-		for {
-			select {
-			case signal := <-handler.SignalMsg():
-				cmd.Process.Signal(signal.Signal)
-			case <-exitCtx.Done():
-				//fmt.Println("break sig")
-				return
-			}
-		}
+		defer close(output)
+		CopyBufferWithContext(session, pty, wbuf, ctx)
 	}()
+	go CopyBufferWithContext(pty, session, rbuf, exitCtx)
+	// 接受窗口改变消息，并应用于 pty；关闭 pty 之前需要等待其退出
+	defer handler.startWindowChanges(ctx, exitCtx, pty)()
 
+	start := time.Now()
 	if err := cmd.Start(); err != nil {
 		session.Close()
 		cancel()
 		return err
 	}
+	// 子进程已经持有 tty，关闭之后，所有子进程退出时读取 pty 将返回错误，输出的复制随之结束
+	tty.Close()
+	timedOut := handler.startExecTimer(ctx, request, cmd)
+	// 客户端断开连接时挂断子进程
+	exited := make(chan struct{})
+	go handler.hangup(ctx, cmd, exited)
+	// 接受 Signal 消息，并应用于 Process
+	go handler.forwardSignals(ctx, exitCtx, cmd)
 
 	err = cmd.Wait()
+	close(exited)
+	duration := time.Since(start)
+	// 后台进程可能仍然持有 tty，所以最多等待 ptyDrainTimeout
+	select {
+	case <-output:
+	case <-time.After(ptyDrainTimeout):
+	}
 	cancel()
-	handler.SendExitStatus(cmd.ProcessState.ExitCode(), true, session)
+	killed := timedOut()
+	handler.auditCommand(ctx, cmdline, cmd.ProcessState, killed, duration)
+	if killed {
+		handler.SendExitStatus(ExecTimeoutStatus, true, session)
+		return err
+	}
+	handler.SendExitState(cmd.ProcessState, session)
 	return err
 }
+
+// 子进程退出后，等待 pty 中剩余输出发送完毕的最长时间
+const ptyDrainTimeout = time.Second
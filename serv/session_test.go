@@ -0,0 +1,161 @@
+package serv
+
+import (
+	"github.com/nishoushun/gosshd"
+	"github.com/nishoushun/gosshd/serv/testutil"
+	"golang.org/x/crypto/ssh"
+	"os/user"
+	"runtime"
+	"sync"
+	"testing"
+)
+
+// TestReqHandlerRegistrationWhileServing 在处理 session 的同时注册与移除请求处理函数、subsystem 以及进程内服务，需要以 -race 运行
+func TestReqHandlerRegistrationWhileServing(t *testing.T) {
+	handler := NewSessionHandler(1, 1, 0)
+	handler.SetReqHandlerFunc(gosshd.ReqSubsystem, handler.HandleSubsystemReq)
+	echo := ChannelServiceFunc(func(ctx gosshd.Context, ch gosshd.Channel, session *ServiceSession) int {
+		return 0
+	})
+	_, dial := testutil.NewTestServer(func(sshd *gosshd.SSHServer) {
+		sshd.SetNewChanHandleFunc(gosshd.SessionTypeChannel, func(ctx gosshd.Context, c gosshd.NewChannel) {
+			handler.Start(ctx, c)
+		})
+	})
+
+	done := make(chan struct{})
+	registered := make(chan struct{})
+	go func() {
+		defer close(registered)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			handler.SetReqHandlerFunc(gosshd.ReqEnv, handler.HandleEnvReq)
+			handler.SetService("echo", echo)
+			// 命令行为空的 subsystem 请求会被拒绝，不会执行任何命令
+			handler.SetSubsystem("empty", "")
+			handler.RemoveReqHandler(gosshd.ReqEnv)
+			runtime.Gosched()
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			client := dial()
+			defer client.Close()
+			for j := 0; j < 20; j++ {
+				session, err := client.NewSession()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				// 处理函数随时可能被移除，所以只关心是否发生数据竞争，不关心请求是否被接受
+				session.Setenv("LANG", "C")
+				session.RequestSubsystem([]string{"echo", "empty"}[j%2])
+				session.Wait()
+				session.Close()
+			}
+		}()
+	}
+	wg.Wait()
+	close(done)
+	<-registered
+}
+
+// TestExitSignalOnKill 子进程被 SIGKILL 杀死时，客户端应当收到 exit-signal KILL，而不是负数或者溢出的 exit-status
+func TestExitSignalOnKill(t *testing.T) {
+	current, err := user.Current()
+	if err != nil {
+		t.Skip(err)
+	}
+	handler := NewSessionHandler(1, 1, 0)
+	handler.SetDefaults()
+	handler.DropPrivileges = false
+	_, dial := testutil.NewTestServer(func(sshd *gosshd.SSHServer) {
+		sshd.LookupUserCallback = func(metadata gosshd.ConnMetadata) (*gosshd.User, error) {
+			return UnixUserInfo(current.Username)
+		}
+		sshd.SetNewChanHandleFunc(gosshd.SessionTypeChannel, func(ctx gosshd.Context, c gosshd.NewChannel) {
+			handler.Start(ctx, c)
+		})
+	})
+	client := dial()
+	defer client.Close()
+
+	// 直接使用 channel，以便检查服务端发送的原始请求
+	channel, requests, err := client.OpenChannel(gosshd.SessionTypeChannel, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer channel.Close()
+	if ok, err := channel.SendRequest(gosshd.ReqExec, true, ssh.Marshal(&gosshd.ExecMsg{Command: "sleep 30"})); !ok || err != nil {
+		t.Fatalf("exec rejected: %v", err)
+	}
+	if _, err := channel.SendRequest(gosshd.ReqSignal, false, ssh.Marshal(&gosshd.SignalMsg{Signal: gosshd.SIGKILL})); err != nil {
+		t.Fatal(err)
+	}
+
+	var signal *gosshd.ExitSignalMsg
+	for request := range requests {
+		switch request.Type {
+		case gosshd.ExitSignal:
+			signal = &gosshd.ExitSignalMsg{}
+			if err := ssh.Unmarshal(request.Payload, signal); err != nil {
+				t.Fatal(err)
+			}
+		case gosshd.ExitStatus:
+			status := &gosshd.ExitStatusMsg{}
+			if err := ssh.Unmarshal(request.Payload, status); err != nil {
+				t.Fatal(err)
+			}
+			if status.Status > 255 {
+				t.Errorf("exit-status = %d, want a value in [0, 255]", status.Status)
+			}
+		}
+	}
+	if signal == nil {
+		t.Fatal("no exit-signal received")
+	}
+	if signal.Signal != gosshd.SIGKILL {
+		t.Fatalf("exit-signal = %q, want %q", signal.Signal, gosshd.SIGKILL)
+	}
+}
+
+// TestShellStartFailure 接受 shell 请求之后登陆程序启动失败时，客户端应当收到 exit-status 1，而不是一直等待
+func TestShellStartFailure(t *testing.T) {
+	handler := NewSessionHandler(1, 1, 0)
+	handler.SetDefaults()
+	handler.LoginProgram = []string{"/nonexistent/login", "-f", "%u"}
+	_, dial := testutil.NewTestServer(func(sshd *gosshd.SSHServer) {
+		sshd.LookupUserCallback = func(metadata gosshd.ConnMetadata) (*gosshd.User, error) {
+			return &gosshd.User{UserName: metadata.User(), HomeDir: "/"}, nil
+		}
+		sshd.SetNewChanHandleFunc(gosshd.SessionTypeChannel, func(ctx gosshd.Context, c gosshd.NewChannel) {
+			handler.Start(ctx, c)
+		})
+	})
+	client := dial()
+	defer client.Close()
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	if err := session.RequestPty("xterm", 24, 80, ssh.TerminalModes{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := session.Shell(); err != nil {
+		t.Fatal(err)
+	}
+	err = session.Wait()
+	exitErr, ok := err.(*ssh.ExitError)
+	if !ok || exitErr.ExitStatus() != 1 {
+		t.Fatalf("Wait() = %v, want exit status 1", err)
+	}
+}
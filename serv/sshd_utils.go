@@ -1,30 +1,43 @@
+// Package serv 包含 gosshd 的默认实现以及工具函数，例如 session、direct-tcpip、forwarded-tcpip 的处理器，
+// 以及 Unix 系统下的身份认证、用户信息查询等；旧版文档中的 utils 包已由该包代替。
 package serv
 
 import (
 	"github.com/nishoushun/gosshd"
+	"log"
+	"time"
 )
 
 // SimpleServerOnUnix 创建一个默认的 ssh server 实例，所有的处理器均为默认处理器
-// 使用 Open-SSH 服务器密钥作为主机密钥；只适用于 Unix 系统
+// 使用 Open-SSH 服务器密钥作为主机密钥，只要有一个密钥加载成功即可（例如只有 ssh_host_ed25519_key 的容器），
+// 加载失败的密钥通过标准库 log 输出，所有密钥均加载失败时返回 HostKeyLoadError；只适用于 Unix 系统
 func SimpleServerOnUnix() (*gosshd.SSHServer, error) {
 	sshd := gosshd.NewSSHServer()
-	err := sshd.LoadHostKey(RSAHostKeyPath)
-	err = sshd.LoadHostKey(ECDSAHostKeyPath)
-	err = sshd.LoadHostKey(ED25519HostKeyPath)
-	if err != nil {
-		return nil, err
+	// 每个密钥独立加载，至少加载了一个密钥即可
+	failures := map[string]error{}
+	for _, path := range []string{RSAHostKeyPath, ECDSAHostKeyPath, ED25519HostKeyPath} {
+		if err := sshd.LoadHostKey(path); err != nil {
+			failures[path] = err
+		}
+	}
+	if sshd.HostKeyCount() == 0 {
+		return nil, gosshd.HostKeyLoadError{Failures: failures}
+	}
+	for path, err := range failures {
+		log.Printf("gosshd: skip host key %s: %v", path, err)
 	}
 	sshd.LookupUserCallback = func(metadata gosshd.ConnMetadata) (*gosshd.User, error) {
 		return UnixUserInfo(metadata.User())
 	}
+	sshd.HandshakeTimeout = 2 * time.Minute
 	sshd.SetPasswdCallback(CheckUnixPasswd)
 	sshd.NewChannel(gosshd.SessionTypeChannel, func(ctx gosshd.Context, c gosshd.NewChannel) {
-		handler := NewSessionChannelHandler(10, 10, 10, 0)
+		handler := NewSessionHandler(10, 10, 0)
 		handler.SetDefaults()
 		handler.Start(ctx, c)
 	})
 	sshd.NewChannel(gosshd.DirectTcpIpChannel, NewTcpIpDirector(0).HandleDirectTcpIP)
-	fhandler := NewForwardedTcpIpHandler(0)
+	fhandler := NewForwardedTcpIpHandler(0, DefaultMaxForwardedConns)
 	sshd.NewGlobalRequest(gosshd.GlobalReqTcpIpForward, fhandler.ServeForward)
 	sshd.NewGlobalRequest(gosshd.GlobalReqCancelTcpIpForward, fhandler.CancelForward)
 	return sshd, nil
@@ -0,0 +1,133 @@
+// Package testutil 提供在进程内测试 gosshd 处理器的工具，服务端与客户端之间通过内存中的 net.Pipe 连接，
+// 不需要监听网络端口，也不需要主机密钥文件。
+package testutil
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"github.com/nishoushun/gosshd"
+	"golang.org/x/crypto/ssh"
+	"net"
+	"sync"
+)
+
+// User 测试客户端使用的用户名
+const User = "test"
+
+// NewTestServer 创建一个使用随机 ed25519 主机密钥、不需要身份认证的 SSHServer，并依次调用 setups 对其进行配置，
+// 例如注册 channel 处理函数、设置 LookupUserCallback 等；
+// 返回的 dial 函数每次调用都会建立一个新的内存连接，并返回以 User 作为用户名的 ssh.Client，建立连接失败时 panic。例如：
+//
+//	server, dial := testutil.NewTestServer(func(sshd *gosshd.SSHServer) {
+//		sshd.SetNewChanHandleFunc(gosshd.SessionTypeChannel, func(ctx gosshd.Context, c gosshd.NewChannel) {
+//			handler.Start(ctx, c)
+//		})
+//	})
+//	client := dial()
+//	defer client.Close()
+//	session, _ := client.NewSession()
+//	output, err := session.Output("echo hello")
+func NewTestServer(setups ...func(sshd *gosshd.SSHServer)) (*gosshd.SSHServer, func() *ssh.Client) {
+	sshd := gosshd.NewSSHServer()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		panic(err)
+	}
+	sshd.AddHostSigner(signer)
+	sshd.AllowNoAuth(true)
+	for _, setup := range setups {
+		setup(sshd)
+	}
+
+	dial := func() *ssh.Client {
+		client, err := Dial(sshd)
+		if err != nil {
+			panic(err)
+		}
+		return client
+	}
+	return sshd, dial
+}
+
+// Dial 通过内存连接与 sshd 建立 SSH 连接，以 User 作为用户名，不校验主机密钥
+func Dial(sshd *gosshd.SSHServer) (*ssh.Client, error) {
+	serverConn, clientConn := net.Pipe()
+	go sshd.HandleConn(serverConn)
+	conn := newAsyncWriteConn(clientConn)
+	c, chans, reqs, err := ssh.NewClientConn(conn, "pipe", &ssh.ClientConfig{
+		User:            User,
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+// asyncWriteConn 由单独的协程将数据写入 net.Conn，使 Write 不会阻塞；
+// net.Pipe 没有缓冲，而双方在交换版本号时都是先写后读，两端同时同步写入将导致死锁
+type asyncWriteConn struct {
+	net.Conn
+	writes    chan []byte
+	done      chan struct{}
+	closeOnce sync.Once
+
+	mu  sync.Mutex
+	err error // 写入失败的原因
+}
+
+func newAsyncWriteConn(conn net.Conn) *asyncWriteConn {
+	c := &asyncWriteConn{
+		Conn:   conn,
+		writes: make(chan []byte, 64),
+		done:   make(chan struct{}),
+	}
+	go c.writeLoop()
+	return c
+}
+
+func (c *asyncWriteConn) writeLoop() {
+	for {
+		select {
+		case b := <-c.writes:
+			if _, err := c.Conn.Write(b); err != nil {
+				c.mu.Lock()
+				c.err = err
+				c.mu.Unlock()
+				c.Close()
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *asyncWriteConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	err := c.err
+	c.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	select {
+	case c.writes <- append([]byte(nil), b...):
+		return len(b), nil
+	case <-c.done:
+		return 0, net.ErrClosed
+	}
+}
+
+func (c *asyncWriteConn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		close(c.done)
+		err = c.Conn.Close()
+	})
+	return err
+}
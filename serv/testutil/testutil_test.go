@@ -0,0 +1,50 @@
+package testutil
+
+import (
+	"github.com/nishoushun/gosshd"
+	"testing"
+)
+
+func TestNewTestServer(t *testing.T) {
+	users := make(chan string, 1)
+	_, dial := NewTestServer(func(sshd *gosshd.SSHServer) {
+		sshd.SetNewChanHandleFunc(gosshd.SessionTypeChannel, func(ctx gosshd.Context, c gosshd.NewChannel) {
+			users <- ctx.Conn().User()
+			channel, requests, err := c.Accept()
+			if err != nil {
+				return
+			}
+			defer channel.Close()
+			for request := range requests {
+				if request.Type != gosshd.ReqExec {
+					request.Reply(false, nil)
+					continue
+				}
+				request.Reply(true, nil)
+				channel.Write([]byte("hello\n"))
+				gosshd.SendExitStatus(channel, 0)
+				return
+			}
+		})
+	})
+
+	// 每次 dial 都建立一个新的连接
+	for i := 0; i < 2; i++ {
+		client := dial()
+		session, err := client.NewSession()
+		if err != nil {
+			t.Fatal(err)
+		}
+		output, err := session.Output("echo hello")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(output) != "hello\n" {
+			t.Fatalf("output = %q, want %q", output, "hello\n")
+		}
+		if user := <-users; user != User {
+			t.Fatalf("user = %q, want %q", user, User)
+		}
+		client.Close()
+	}
+}
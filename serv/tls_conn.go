@@ -0,0 +1,41 @@
+package serv
+
+import (
+	"crypto/tls"
+	"github.com/nishoushun/gosshd"
+	"net"
+	"time"
+)
+
+// TLSHandshakeTimeout 完成 TLS 握手的超时时间
+var TLSHandshakeTimeout = 10 * time.Second
+
+// WrapTLSConn 返回一个 TransformConnCallback，在 SSH 握手之前与客户端完成 TLS 握手，之后的 SSH 数据通过 TLS 传输，
+// 可用于 443 端口上的 SSH（类似 stunnel），例如 OpenSSH 客户端可以使用 ProxyCommand "openssl s_client -quiet -connect %h:443"；
+// 返回的 net.Conn 的 RemoteAddr 与 LocalAddr 为原始连接的地址。握手失败或超时时返回 error，该连接将被关闭。
+// 与 ProxyProtocolConn 一起使用时，应当先剥离 PROXY 协议头：
+//
+//	proxy, wrap := serv.ProxyProtocolConn(), serv.WrapTLSConn(config)
+//	sshd.TransformConnCallback = func(conn net.Conn) (net.Conn, error) {
+//		conn, err := proxy(conn)
+//		if err != nil {
+//			return nil, err
+//		}
+//		return wrap(conn)
+//	}
+func WrapTLSConn(config *tls.Config) gosshd.TransformConnCallback {
+	return func(conn net.Conn) (net.Conn, error) {
+		tlsConn := tls.Server(conn, config)
+		if err := conn.SetDeadline(time.Now().Add(TLSHandshakeTimeout)); err != nil {
+			return nil, err
+		}
+		if err := tlsConn.Handshake(); err != nil {
+			return nil, err
+		}
+		// 清除握手超时
+		if err := conn.SetDeadline(time.Time{}); err != nil {
+			return nil, err
+		}
+		return tlsConn, nil
+	}
+}
@@ -0,0 +1,97 @@
+package serv
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"github.com/nishoushun/gosshd"
+	"github.com/nishoushun/gosshd/serv/testutil"
+	"golang.org/x/crypto/ssh"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// selfSignedCert 生成 127.0.0.1 的自签名证书
+func selfSignedCert(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "gosshd test"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+func TestWrapTLSConn(t *testing.T) {
+	cert, pool := selfSignedCert(t)
+	remoteAddrs := make(chan string, 1)
+	sshd, _ := testutil.NewTestServer(func(sshd *gosshd.SSHServer) {
+		sshd.TransformConnCallback = WrapTLSConn(&tls.Config{Certificates: []tls.Certificate{cert}})
+		sshd.SSHConnLogCallback = func(ctx gosshd.Context) error {
+			remoteAddrs <- ctx.RemoteAddr().String()
+			return nil
+		}
+	})
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go sshd.Serve(listener)
+	defer sshd.Close()
+
+	conn, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{RootCAs: pool})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	c, chans, reqs, err := ssh.NewClientConn(conn, listener.Addr().String(), &ssh.ClientConfig{
+		User:            testutil.User,
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := ssh.NewClient(c, chans, reqs)
+	defer client.Close()
+
+	// RemoteAddr 应当是客户端 TCP 连接的地址，而不是 TLS 层的地址
+	if addr := <-remoteAddrs; addr != conn.LocalAddr().String() {
+		t.Fatalf("RemoteAddr = %s, want %s", addr, conn.LocalAddr())
+	}
+}
+
+func TestWrapTLSConnRejectsPlainSSH(t *testing.T) {
+	cert, _ := selfSignedCert(t)
+	wrap := WrapTLSConn(&tls.Config{Certificates: []tls.Certificate{cert}})
+	server, client := net.Pipe()
+	defer client.Close()
+	go client.Write([]byte("SSH-2.0-OpenSSH_9.0\r\n"))
+	if _, err := wrap(server); err == nil {
+		t.Fatal("TLS handshake with a plain SSH client succeeded")
+	}
+}
@@ -0,0 +1,146 @@
+package serv
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/nishoushun/gosshd"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// TranscriptStore 会话记录的存储，可以由文件、S3、数据库等实现；
+// DefaultSessionChanHandler 设置了 TranscriptStore 时，每个 session 开始时调用 Open，结束时关闭返回的 WriteCloser
+type TranscriptStore interface {
+	Open(sessionID string) (io.WriteCloser, error)
+}
+
+// FileTranscriptStore 将每个 session 的记录以 asciicast v2 格式写入 Dir 目录下的 <sessionID>.cast 文件，
+// 可以通过 asciinema play 回放
+type FileTranscriptStore struct {
+	Dir    string
+	Width  int // asciicast 头部中的终端宽度，默认为 80
+	Height int // asciicast 头部中的终端高度，默认为 24
+}
+
+// NewFileTranscriptStore 创建一个将记录写入 dir 目录的 FileTranscriptStore
+func NewFileTranscriptStore(dir string) *FileTranscriptStore {
+	return &FileTranscriptStore{Dir: dir, Width: 80, Height: 24}
+}
+
+// Open 创建 <sessionID>.cast 文件，并写入 asciicast 头部
+func (s *FileTranscriptStore) Open(sessionID string) (io.WriteCloser, error) {
+	if err := os.MkdirAll(s.Dir, 0700); err != nil {
+		return nil, err
+	}
+	name := filepath.Join(s.Dir, filepath.Base(sessionID)+".cast")
+	file, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	width, height := s.Width, s.Height
+	if width <= 0 {
+		width = 80
+	}
+	if height <= 0 {
+		height = 24
+	}
+	return NewAsciicastWriter(file, width, height)
+}
+
+// NewAsciicastWriter 创建一个将写入的数据以 asciicast v2 输出事件的形式写入 w 的 WriteCloser，关闭时同时关闭 w
+func NewAsciicastWriter(w io.WriteCloser, width, height int) (io.WriteCloser, error) {
+	start := time.Now()
+	header := struct {
+		Version   int   `json:"version"`
+		Width     int   `json:"width"`
+		Height    int   `json:"height"`
+		Timestamp int64 `json:"timestamp"`
+	}{2, width, height, start.Unix()}
+	if err := json.NewEncoder(w).Encode(header); err != nil {
+		w.Close()
+		return nil, err
+	}
+	return &asciicastWriter{w: w, start: start}, nil
+}
+
+type asciicastWriter struct {
+	sync.Mutex
+	w     io.WriteCloser
+	start time.Time
+}
+
+func (a *asciicastWriter) Write(b []byte) (int, error) {
+	a.Lock()
+	defer a.Unlock()
+	event := []interface{}{time.Since(a.start).Seconds(), "o", string(b)}
+	if err := json.NewEncoder(a.w).Encode(event); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (a *asciicastWriter) Close() error {
+	return a.w.Close()
+}
+
+// transcriptSessionID 生成 session 记录的标识，同一个连接中的多个 session 使用相同的会话标识，所以附加开始时间
+func transcriptSessionID(ctx gosshd.Context) string {
+	return fmt.Sprintf("%s-%d", hex.EncodeToString(ctx.Conn().SessionID()), time.Now().UnixNano())
+}
+
+// NewTranscriptChannel 包装 channel，发送至客户端的数据（包括 Stderr）将被同时写入 transcript；
+// 写入 transcript 失败不会影响 session，失败后不再继续记录
+func NewTranscriptChannel(channel gosshd.Channel, transcript io.Writer) gosshd.Channel {
+	return &transcriptChannel{Channel: channel, transcript: &bestEffortWriter{w: transcript}}
+}
+
+type transcriptChannel struct {
+	gosshd.Channel
+	transcript *bestEffortWriter
+}
+
+func (c *transcriptChannel) Write(b []byte) (int, error) {
+	n, err := c.Channel.Write(b)
+	c.transcript.Write(b[:n])
+	return n, err
+}
+
+func (c *transcriptChannel) Stderr() io.ReadWriter {
+	return &transcriptStderr{ReadWriter: c.Channel.Stderr(), transcript: c.transcript}
+}
+
+type transcriptStderr struct {
+	io.ReadWriter
+	transcript *bestEffortWriter
+}
+
+func (s *transcriptStderr) Write(b []byte) (int, error) {
+	n, err := s.ReadWriter.Write(b)
+	s.transcript.Write(b[:n])
+	return n, err
+}
+
+// bestEffortWriter 写入失败后忽略之后的所有数据
+type bestEffortWriter struct {
+	sync.Mutex
+	w      io.Writer
+	failed bool
+}
+
+func (b *bestEffortWriter) Write(p []byte) {
+	if len(p) == 0 {
+		return
+	}
+	b.Lock()
+	defer b.Unlock()
+	if b.failed {
+		return
+	}
+	if _, err := b.w.Write(p); err != nil {
+		b.failed = true
+	}
+}
@@ -0,0 +1,283 @@
+package serv
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/nishoushun/gosshd"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"sync"
+)
+
+// 本文件实现 OpenSSH 的 tun@openssh.com 扩展（ssh -w），在客户端与服务器的 tun/tap 设备之间转发 IP 数据包或以太网帧，
+// 协议定义于 https://cvsweb.openbsd.org/src/usr.bin/ssh/PROTOCOL 2.3.
+
+// TunChannelType tun 转发的 channel 类型
+const TunChannelType = "tun@openssh.com"
+
+// tun 转发的模式
+const (
+	TunModePointToPoint uint32 = 1 // 三层隧道，转发 IP 数据包，对应 tun 设备
+	TunModeEthernet     uint32 = 2 // 二层隧道，转发以太网帧，对应 tap 设备
+)
+
+// TunAnyUnit 客户端未指定设备编号（ssh -w any）时的设备编号，由内核分配
+const TunAnyUnit uint32 = 0x7fffffff
+
+// tunOpenMsg tun@openssh.com channel 建立请求的额外数据
+type tunOpenMsg struct {
+	Mode uint32
+	Unit uint32
+}
+
+// 数据包中的地址族使用 OpenBSD 的取值
+const (
+	tunAFInet  uint32 = 2
+	tunAFInet6 uint32 = 24
+)
+
+// tunMaxPacket 单个数据包的最大长度：以太网头部（包括 VLAN 标签）与最大的 IPv6 数据包
+const tunMaxPacket = 18 + 40 + 65535
+
+var TunNotSupportedErr = errors.New("tun device not supported on this platform")
+
+var InvalidTunPacketErr = errors.New("invalid tun packet")
+
+// TunDevice 由 OpenTunDevice 打开的 tun/tap 设备，每次 Read 读取一个完整的数据包或以太网帧，每次 Write 写入一个
+type TunDevice interface {
+	io.ReadWriteCloser
+	Name() string // 设备名称，例如 tun0
+}
+
+// NewTunForwarder 创建一个 TunForwarder，支持两种模式
+func NewTunForwarder() *TunForwarder {
+	return &TunForwarder{PointToPoint: true, Ethernet: true}
+}
+
+// TunForwarder tun@openssh.com 类型的 channel 处理，为每个 channel 创建一个 tun（或 tap）设备，
+// 并在设备与 channel 之间转发数据包，channel 关闭时设备随之删除；只支持 Linux，且需要 CAP_NET_ADMIN 权限
+type TunForwarder struct {
+	PointToPoint bool // 是否允许三层隧道（ssh -o Tunnel=point-to-point）
+	Ethernet     bool // 是否允许二层隧道（ssh -o Tunnel=ethernet）
+
+	// 设备创建之后、开始转发之前调用，用于配置设备的地址、路由等，例如执行 ip addr add；
+	// name 为设备名称，返回 error 时拒绝该 channel。为 nil 时设备保持未配置的状态，需要在外部配置
+	Setup func(ctx gosshd.Context, name string, mode uint32) error
+}
+
+// HandleTun 开始处理一个 tun@openssh.com 类型的信道，打开客户端请求的设备，并转发双方的数据包
+func (f *TunForwarder) HandleTun(ctx gosshd.Context, newChannel gosshd.NewChannel) {
+	if newChannel.ChannelType() != TunChannelType {
+		return
+	}
+	msg := &tunOpenMsg{}
+	if err := ssh.Unmarshal(newChannel.ExtraData(), msg); err != nil {
+		newChannel.Reject(ssh.Prohibited, "invalid tun metadata")
+		return
+	}
+	if (msg.Mode == TunModePointToPoint && !f.PointToPoint) || (msg.Mode == TunModeEthernet && !f.Ethernet) ||
+		(msg.Mode != TunModePointToPoint && msg.Mode != TunModeEthernet) {
+		newChannel.Reject(ssh.Prohibited, fmt.Sprintf("tunnel mode %d not permitted", msg.Mode))
+		return
+	}
+	dev, err := OpenTunDevice(msg.Mode, msg.Unit)
+	if err != nil {
+		newChannel.Reject(gosshd.ConnectionFailed, err.Error())
+		return
+	}
+	defer dev.Close()
+	if f.Setup != nil {
+		if err := f.Setup(ctx, dev.Name(), msg.Mode); err != nil {
+			newChannel.Reject(gosshd.ConnectionFailed, err.Error())
+			return
+		}
+	}
+	channel, requests, err := newChannel.Accept()
+	if err != nil {
+		return
+	}
+	defer channel.Close()
+	go gosshd.DiscardRequests(ctx, requests)
+
+	// 任意一个方向结束或者 ctx 被取消时，关闭设备与 channel，使另一个方向随之结束
+	var once sync.Once
+	done := make(chan struct{})
+	stop := func() {
+		once.Do(func() {
+			close(done)
+			dev.Close()
+			channel.Close()
+		})
+	}
+	go func() {
+		tunToChannel(channel, dev, msg.Mode)
+		stop()
+	}()
+	go func() {
+		channelToTun(dev, channel, msg.Mode)
+		stop()
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		stop()
+	}
+}
+
+// tunToChannel 从设备读取数据包，每个数据包作为一个 channel 数据消息发送，三层隧道在数据包之前加上地址族
+func tunToChannel(channel io.Writer, dev io.Reader, mode uint32) error {
+	buf := make([]byte, 4+tunMaxPacket)
+	for {
+		n, err := dev.Read(buf[4:])
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			continue
+		}
+		packet := buf[4 : 4+n]
+		if mode == TunModePointToPoint {
+			af := tunAFInet
+			if packet[0]>>4 == 6 {
+				af = tunAFInet6
+			}
+			binary.BigEndian.PutUint32(buf, af)
+			packet = buf[:4+n]
+		}
+		if _, err := channel.Write(packet); err != nil {
+			return err
+		}
+	}
+}
+
+// channelToTun 从 channel 读取数据包，去掉三层隧道的地址族后写入设备
+func channelToTun(dev io.Writer, channel io.Reader, mode uint32) error {
+	reader := bufio.NewReader(channel)
+	buf := make([]byte, tunMaxPacket)
+	for {
+		packet, err := readTunPacket(reader, buf, mode)
+		if err != nil {
+			return err
+		}
+		// 写入失败（例如设备尚未启用）只丢弃该数据包，与网络设备的行为一致
+		dev.Write(packet)
+	}
+}
+
+// readTunPacket 从 reader 中读取一个数据包；OpenSSH 以单个 channel 数据消息发送每个数据包，
+// 而 Channel 是字节流，消息的边界在读取时丢失，所以根据 IP、ARP 头部中的长度重新分割数据包。
+// 因此以太网模式只支持 IPv4、IPv6、ARP 以及带有 VLAN 标签的这些帧，其他类型的帧无法分割，将关闭隧道
+func readTunPacket(reader *bufio.Reader, buf []byte, mode uint32) ([]byte, error) {
+	if mode == TunModePointToPoint {
+		hdr, err := reader.Peek(4 + 6)
+		if err != nil {
+			return nil, err
+		}
+		length, err := ipPacketLength(hdr[4:])
+		if err != nil {
+			return nil, err
+		}
+		if _, err := reader.Discard(4); err != nil {
+			return nil, err
+		}
+		return readFull(reader, buf, length)
+	}
+	length, err := ethernetFrameLength(reader)
+	if err != nil {
+		return nil, err
+	}
+	packet, err := readFull(reader, buf, length)
+	if err != nil {
+		return nil, err
+	}
+	skipEthernetPadding(reader, length)
+	return packet, nil
+}
+
+// readFull 读取 length 个字节至 buf 中
+func readFull(reader io.Reader, buf []byte, length int) ([]byte, error) {
+	if length > len(buf) {
+		return nil, InvalidTunPacketErr
+	}
+	if _, err := io.ReadFull(reader, buf[:length]); err != nil {
+		return nil, err
+	}
+	return buf[:length], nil
+}
+
+// ipPacketLength 根据 IP 头部计算 IP 数据包的长度，hdr 至少包含 6 个字节
+func ipPacketLength(hdr []byte) (int, error) {
+	switch hdr[0] >> 4 {
+	case 4:
+		if length := int(binary.BigEndian.Uint16(hdr[2:])); length >= 20 {
+			return length, nil
+		}
+	case 6:
+		return 40 + int(binary.BigEndian.Uint16(hdr[4:])), nil
+	}
+	return 0, InvalidTunPacketErr
+}
+
+// 以太网帧的类型
+const (
+	etherTypeIPv4   = 0x0800
+	etherTypeARP    = 0x0806
+	etherTypeVLAN   = 0x8100
+	etherTypeQinQ   = 0x88a8
+	etherTypeIPv6   = 0x86dd
+	etherHeaderLen  = 14
+	etherMinLen     = 60 // 不包括 FCS 的最小帧长度，较短的帧可能被填充
+	etherVLANTagLen = 4
+)
+
+// ethernetFrameLength 根据以太网头部以及上层协议的头部计算帧的长度
+func ethernetFrameLength(reader *bufio.Reader) (int, error) {
+	offset := etherHeaderLen
+	hdr, err := reader.Peek(offset)
+	if err != nil {
+		return 0, err
+	}
+	etherType := binary.BigEndian.Uint16(hdr[offset-2:])
+	if etherType == etherTypeVLAN || etherType == etherTypeQinQ {
+		offset += etherVLANTagLen
+		if hdr, err = reader.Peek(offset); err != nil {
+			return 0, err
+		}
+		etherType = binary.BigEndian.Uint16(hdr[offset-2:])
+	}
+	switch etherType {
+	case etherTypeIPv4, etherTypeIPv6:
+		if hdr, err = reader.Peek(offset + 6); err != nil {
+			return 0, err
+		}
+		length, err := ipPacketLength(hdr[offset:])
+		return offset + length, err
+	case etherTypeARP:
+		if hdr, err = reader.Peek(offset + 6); err != nil {
+			return 0, err
+		}
+		return offset + 8 + 2*(int(hdr[offset+4])+int(hdr[offset+5])), nil
+	}
+	return 0, InvalidTunPacketErr
+}
+
+// skipEthernetPadding 丢弃短帧之后已经收到的填充字节；填充与帧位于同一个消息中，所以只检查已经缓存的数据，
+// 以全为 0 的字节作为填充，因为下一个帧的目的 MAC 地址不会全为 0
+func skipEthernetPadding(reader *bufio.Reader, length int) {
+	n := etherMinLen - length
+	if n <= 0 {
+		return
+	}
+	if buffered := reader.Buffered(); buffered < n {
+		n = buffered
+	}
+	padding, _ := reader.Peek(n)
+	for _, b := range padding {
+		if b != 0 {
+			return
+		}
+	}
+	reader.Discard(n)
+}
@@ -0,0 +1,56 @@
+//go:build linux
+
+package serv
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// TunDeviceFile Linux 下 tun/tap 设备的控制文件
+var TunDeviceFile = "/dev/net/tun"
+
+// linux/if_tun.h 中的常量
+const (
+	tunSetIff = 0x400454ca // TUNSETIFF
+	iffTun    = 0x0001
+	iffTap    = 0x0002
+	iffNoPi   = 0x1000
+)
+
+// ifReq struct ifreq 中 TUNSETIFF 使用的部分
+type ifReq struct {
+	Name  [syscall.IFNAMSIZ]byte
+	Flags uint16
+	_     [22]byte
+}
+
+// OpenTunDevice 创建一个 tun 设备（mode 为 TunModePointToPoint）或者 tap 设备（mode 为 TunModeEthernet），
+// unit 为设备编号，例如 0 对应 tun0，为 TunAnyUnit 时由内核分配；设备在关闭之后被删除
+func OpenTunDevice(mode, unit uint32) (TunDevice, error) {
+	req := ifReq{Flags: iffNoPi}
+	prefix := "tun"
+	if mode == TunModeEthernet {
+		req.Flags |= iffTap
+		prefix = "tap"
+	} else {
+		req.Flags |= iffTun
+	}
+	if unit != TunAnyUnit {
+		copy(req.Name[:], fmt.Sprintf("%s%d", prefix, unit))
+	}
+	// 以非阻塞的方式打开，使 os.File 可以通过 netpoller 读写，Close 时能够中断正在进行的 Read
+	fd, err := syscall.Open(TunDeviceFile, syscall.O_RDWR|syscall.O_NONBLOCK|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), tunSetIff, uintptr(unsafe.Pointer(&req))); errno != 0 {
+		syscall.Close(fd)
+		return nil, errno
+	}
+	name := strings.TrimRight(string(req.Name[:]), "\x00")
+	return os.NewFile(uintptr(fd), name), nil
+}
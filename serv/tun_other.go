@@ -0,0 +1,8 @@
+//go:build !linux
+
+package serv
+
+// OpenTunDevice 只支持 Linux，其他系统返回 TunNotSupportedErr
+func OpenTunDevice(mode, unit uint32) (TunDevice, error) {
+	return nil, TunNotSupportedErr
+}
@@ -7,6 +7,7 @@ import (
 	"github.com/nishoushun/gosshd"
 	"os"
 	"os/exec"
+	"os/user"
 	"strings"
 )
 
@@ -15,6 +16,7 @@ import (
 const (
 	Passwd = "/etc/passwd"
 	Shadow = "/etc/shadow"
+	Group  = "/etc/group"
 )
 
 // OpenSSH 在 unix 系统下的密钥路径
@@ -30,12 +32,83 @@ const (
 	DSAHostPublicKeyPath     = "/etc/ssh/ssh_host_dsa_key.pub"
 )
 
-// UnixUserInfo 从 CrossPlatformPasswordCallback 文件中解析用户信息
-func UnixUserInfo(user string) (*gosshd.User, error) {
-	line, err := FindUserLog(Passwd, user)
+// SftpSubsystem sftp subsystem 的名称
+const SftpSubsystem = "sftp"
+
+// SftpServerPaths 不同发行版中 OpenSSH sftp-server 程序的路径
+var SftpServerPaths = []string{
+	"/usr/lib/openssh/sftp-server",
+	"/usr/libexec/openssh/sftp-server",
+	"/usr/lib/ssh/sftp-server",
+	"/usr/libexec/sftp-server",
+}
+
+// LookupSftpServer 在 SftpServerPaths 中查找第一个存在的 sftp-server 程序
+func LookupSftpServer() (string, error) {
+	for _, p := range SftpServerPaths {
+		if info, err := os.Stat(p); err == nil && !info.IsDir() {
+			return p, nil
+		}
+	}
+	return "", fmt.Errorf("sftp-server not found")
+}
+
+// DefaultUserShell 无法获取用户的登陆 shell 时使用的 shell
+const DefaultUserShell = "/bin/sh"
+
+// UnixUserInfo 获取用户信息，优先通过 os/user 查询，以支持 LDAP、SSSD 等 NSS 来源的用户；
+// os/user 不提供登陆 shell，所以 shell 与密码标志位从 passwd 文件或 getent 命令中获取；
+// os/user 不可用时，从 passwd 文件中解析用户信息
+func UnixUserInfo(username string) (*gosshd.User, error) {
+	u, err := user.Lookup(username)
+	if err != nil {
+		var unknown user.UnknownUserError
+		if errors.As(err, &unknown) {
+			return nil, gosshd.UserNotExistError{User: username}
+		}
+		return passwdUserInfo(username)
+	}
+	info := &gosshd.User{
+		UserName:     u.Username,
+		PasswordFlag: "x",
+		Uid:          u.Uid,
+		Gid:          u.Gid,
+		GECOS:        u.Name,
+		HomeDir:      u.HomeDir,
+		Shell:        DefaultUserShell,
+	}
+	entry, err := passwdUserInfo(username)
+	if err != nil {
+		entry, err = getentUserInfo(username)
+	}
+	if err == nil && entry.Uid == info.Uid {
+		info.PasswordFlag = entry.PasswordFlag
+		info.GECOS = entry.GECOS
+		info.Shell = entry.Shell
+	}
+	return info, nil
+}
+
+// passwdUserInfo 从 passwd 文件中解析用户信息
+func passwdUserInfo(username string) (*gosshd.User, error) {
+	line, err := FindUserLog(Passwd, username)
+	if err != nil {
+		return nil, err
+	}
+	return parsePasswdLine(line)
+}
+
+// getentUserInfo 通过 getent 命令获取用户记录，getent 会查询 NSS 配置的所有来源
+func getentUserInfo(username string) (*gosshd.User, error) {
+	output, err := exec.Command("getent", "passwd", "--", username).Output()
 	if err != nil {
 		return nil, err
 	}
+	return parsePasswdLine(strings.TrimSpace(string(output)))
+}
+
+// parsePasswdLine 解析 passwd 文件中的一条用户记录
+func parsePasswdLine(line string) (*gosshd.User, error) {
 	fields := strings.Split(line, ":")
 	if len(fields) != 7 {
 		return nil, fmt.Errorf("wrong CrossPlatformPasswordCallback log format")
@@ -52,6 +125,36 @@ func UnixUserInfo(user string) (*gosshd.User, error) {
 	}, nil
 }
 
+// UnixUserGroups 从 /etc/group 文件中找到用户所在的所有组名，包括用户的主组
+func UnixUserGroups(user *gosshd.User) ([]string, error) {
+	file, err := os.OpenFile(Group, os.O_RDONLY, 0600)
+	if err != nil {
+		return nil, gosshd.PermitNotAllowedError{Msg: err.Error()}
+	}
+	defer file.Close()
+
+	groups := make([]string, 0)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// 格式为 group_name:password:GID:user_list
+		fields := strings.Split(scanner.Text(), ":")
+		if len(fields) != 4 {
+			continue
+		}
+		if fields[2] == user.Gid {
+			groups = append(groups, fields[0])
+			continue
+		}
+		for _, member := range strings.Split(fields[3], ",") {
+			if member == user.UserName {
+				groups = append(groups, fields[0])
+				break
+			}
+		}
+	}
+	return groups, scanner.Err()
+}
+
 // WrongPassword 错误的密码
 var WrongPassword = errors.New("wrong password")
 
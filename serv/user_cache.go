@@ -0,0 +1,104 @@
+package serv
+
+import (
+	"bufio"
+	"github.com/nishoushun/gosshd"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CachedUserInfo 缓存 passwd 文件中解析出的用户信息，避免每个连接都重新读取并逐行扫描 passwd 文件；
+// 当文件的修改时间或大小改变，或者距离上次读取超过 ttl 时，会重新读取文件；可以被多个协程同时使用
+type CachedUserInfo struct {
+	sync.Mutex
+	Path string // passwd 文件路径，默认为 Passwd
+
+	ttl      time.Duration
+	loadedAt time.Time
+	modTime  time.Time
+	size     int64
+	users    map[string]*gosshd.User
+}
+
+// NewCachedUserInfo 创建一个 CachedUserInfo，ttl 为缓存的有效时间，为 0 时只在文件改变时重新读取，例如：
+//
+//	sshd.LookupUserCallback = serv.NewCachedUserInfo(time.Minute).LookupUser
+func NewCachedUserInfo(ttl time.Duration) *CachedUserInfo {
+	return &CachedUserInfo{Path: Passwd, ttl: ttl}
+}
+
+// LookupUser 可作为 SSHServer 的 LookupUserCallback
+func (c *CachedUserInfo) LookupUser(metadata gosshd.ConnMetadata) (*gosshd.User, error) {
+	return c.UserInfo(metadata.User())
+}
+
+// UserInfo 返回缓存中用户信息的副本；passwd 文件中不存在的用户（例如 LDAP、SSSD 等 NSS 来源的用户）
+// 不会被缓存，将通过 UnixUserInfo 查询
+func (c *CachedUserInfo) UserInfo(username string) (*gosshd.User, error) {
+	c.Lock()
+	if err := c.reload(); err != nil {
+		c.Unlock()
+		return nil, err
+	}
+	user, ok := c.users[username]
+	c.Unlock()
+	if !ok {
+		return UnixUserInfo(username)
+	}
+	copied := *user
+	return &copied, nil
+}
+
+// Invalidate 清空缓存，下一次查询时将重新读取文件
+func (c *CachedUserInfo) Invalidate() {
+	c.Lock()
+	defer c.Unlock()
+	c.users = nil
+}
+
+// reload 在缓存失效时重新读取 passwd 文件；调用者需要持有锁
+func (c *CachedUserInfo) reload() error {
+	path := c.Path
+	if path == "" {
+		path = Passwd
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return gosshd.PermitNotAllowedError{Msg: err.Error()}
+	}
+	if c.users != nil && info.ModTime().Equal(c.modTime) && info.Size() == c.size &&
+		(c.ttl <= 0 || time.Since(c.loadedAt) < c.ttl) {
+		return nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return gosshd.PermitNotAllowedError{Msg: err.Error()}
+	}
+	defer file.Close()
+	users := map[string]*gosshd.User{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, err := parsePasswdLine(line)
+		if err != nil {
+			continue
+		}
+		if _, ok := users[user.UserName]; !ok { // 与 FindUserLog 相同，以第一条记录为准
+			users[user.UserName] = user
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	c.users = users
+	c.loadedAt = time.Now()
+	c.modTime = info.ModTime()
+	c.size = info.Size()
+	return nil
+}
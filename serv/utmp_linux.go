@@ -0,0 +1,119 @@
+//go:build linux
+
+package serv
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// utmp 与 wtmp 文件的路径
+var (
+	UtmpFile = "/var/run/utmp"
+	WtmpFile = "/var/log/wtmp"
+)
+
+// ut_type 的取值，See utmp(5)
+const (
+	utUserProcess = 7
+	utDeadProcess = 8
+)
+
+// utmpRecord glibc 在 Linux 下的 struct utmp，共 384 字节，以小端序读写，See utmp(5)
+type utmpRecord struct {
+	Type    int16
+	_       [2]byte
+	Pid     int32
+	Line    [32]byte
+	ID      [4]byte
+	User    [32]byte
+	Host    [256]byte
+	Exit    [2]int16
+	Session int32
+	Sec     int32
+	Usec    int32
+	AddrV6  [16]byte
+	_       [20]byte
+}
+
+// utmpLogin 向 utmp 写入 tty 对应的登陆记录，并向 wtmp 追加一条记录，使 who、w、last 等工具可以看到该 session；
+// 返回的函数用于在 session 结束时将 utmp 中的记录标记为结束，并向 wtmp 追加一条登出记录。写入失败时忽略
+func utmpLogin(ttyName, user, host string, addr net.Addr, pid int) func() {
+	line := strings.TrimPrefix(ttyName, "/dev/")
+	record := newUtmpRecord(utUserProcess, line, pid)
+	copy(record.User[:], user)
+	copy(record.Host[:], host)
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		if ip4 := tcpAddr.IP.To4(); ip4 != nil {
+			copy(record.AddrV6[:], ip4)
+		} else {
+			copy(record.AddrV6[:], tcpAddr.IP.To16())
+		}
+	}
+	writeUtmp(record)
+	appendWtmp(record)
+	return func() {
+		dead := newUtmpRecord(utDeadProcess, line, pid)
+		writeUtmp(dead)
+		appendWtmp(dead)
+	}
+}
+
+func newUtmpRecord(typ int16, line string, pid int) *utmpRecord {
+	now := time.Now()
+	record := &utmpRecord{Type: typ, Pid: int32(pid), Sec: int32(now.Unix()), Usec: int32(now.Nanosecond() / 1000)}
+	copy(record.Line[:], line)
+	// 与 OpenSSH 相同，ut_id 为 ut_line 的最后 4 个字符
+	id := line
+	if len(id) > len(record.ID) {
+		id = id[len(id)-len(record.ID):]
+	}
+	copy(record.ID[:], id)
+	return record
+}
+
+// writeUtmp 替换 utmp 中 ut_id 相同的记录，不存在时追加至文件末尾
+func writeUtmp(record *utmpRecord) {
+	file, err := os.OpenFile(UtmpFile, os.O_RDWR, 0)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX); err != nil {
+		return
+	}
+	defer syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+	size := int64(binary.Size(record))
+	var offset int64
+	for {
+		var existing utmpRecord
+		if err := binary.Read(file, binary.LittleEndian, &existing); err != nil {
+			break
+		}
+		if existing.ID == record.ID && (existing.Type == utUserProcess || existing.Type == utDeadProcess) {
+			break
+		}
+		offset += size
+	}
+	buf := &bytes.Buffer{}
+	binary.Write(buf, binary.LittleEndian, record)
+	file.WriteAt(buf.Bytes(), offset)
+}
+
+// appendWtmp 向 wtmp 追加一条记录
+func appendWtmp(record *utmpRecord) {
+	file, err := os.OpenFile(WtmpFile, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	buf := &bytes.Buffer{}
+	binary.Write(buf, binary.LittleEndian, record)
+	io.Copy(file, buf)
+}
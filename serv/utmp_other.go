@@ -0,0 +1,10 @@
+//go:build !linux
+
+package serv
+
+import "net"
+
+// utmpLogin 只支持 Linux，其他系统不做任何处理
+func utmpLogin(ttyName, user, host string, addr net.Addr, pid int) func() {
+	return func() {}
+}
@@ -1,7 +1,9 @@
 package gosshd
 
 import (
+	"errors"
 	"golang.org/x/crypto/ssh"
+	"sync/atomic"
 )
 
 const (
@@ -14,11 +16,25 @@ const (
 	ReqSubsystem = "subsystem"
 	ReqExit      = "exit"
 	ExitStatus   = "exit-status"
+	ExitSignal   = "exit-signal"
+
+	// OpenSSH 的扩展请求
+	ReqKeepAlive = "keepalive@openssh.com" // 客户端用于检测连接是否存活，需要回复
+	ReqEOW       = "eow@openssh.com"       // end of write，客户端不再读取该 channel 的数据
 )
 
 // Request ssh 包 Request 类型指针的包装
 type Request struct {
 	*ssh.Request
+	replied *uint32 // 不为 nil 时记录请求是否已经回复，用于处理函数 panic 时拒绝尚未回复的请求
+}
+
+// Reply 回复请求，与 ssh 包的 Reply 相同，同时记录该请求已经回复
+func (r Request) Reply(ok bool, payload []byte) error {
+	if r.replied != nil {
+		atomic.StoreUint32(r.replied, 1)
+	}
+	return r.Request.Reply(ok, payload)
 }
 
 // 从 ssh 包中导出的数据结构，
@@ -53,6 +69,49 @@ type SubsystemRequestMsg struct {
 	Subsystem string
 }
 
+// ExitStatusMsg See RFC 4254, section 6.10.
+type ExitStatusMsg struct {
+	Status uint32
+}
+
+// ExitSignalMsg See RFC 4254, section 6.10.
+type ExitSignalMsg struct {
+	Signal     Signal
+	CoreDumped bool
+	Error      string
+	Language   string
+}
+
+// RequestRejectedErr 对方拒绝了需要回复的请求
+var RequestRejectedErr = errors.New("request rejected")
+
+// SendMarshaledRequest 将 v 序列化为请求的 payload 并通过 ch 发送，v 为 nil 时 payload 为空；
+// wantReply 为 true 时等待对方回复，对方拒绝该请求时返回 RequestRejectedErr
+func SendMarshaledRequest(ch Channel, name string, wantReply bool, v interface{}) error {
+	var payload []byte
+	if v != nil {
+		payload = ssh.Marshal(v)
+	}
+	ok, err := ch.SendRequest(name, wantReply, payload)
+	if err != nil {
+		return err
+	}
+	if wantReply && !ok {
+		return RequestRejectedErr
+	}
+	return nil
+}
+
+// SendExitStatus 向客户端发送 exit-status 请求，告知命令的退出码
+func SendExitStatus(ch Channel, status uint32) error {
+	return SendMarshaledRequest(ch, ExitStatus, false, &ExitStatusMsg{Status: status})
+}
+
+// SendExitSignal 向客户端发送 exit-signal 请求，告知命令因信号 sig 而终止；msg 为错误信息
+func SendExitSignal(ch Channel, sig Signal, coreDumped bool, msg string) error {
+	return SendMarshaledRequest(ch, ExitSignal, false, &ExitSignalMsg{Signal: sig, CoreDumped: coreDumped, Error: msg})
+}
+
 type Signal string
 
 const (
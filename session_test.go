@@ -0,0 +1,84 @@
+package gosshd
+
+import (
+	"errors"
+	"golang.org/x/crypto/ssh"
+	"testing"
+)
+
+// fakeChannel 记录发送的请求，并以 reply 回复需要回复的请求
+type fakeChannel struct {
+	ssh.Channel
+	reply     bool
+	name      string
+	wantReply bool
+	payload   []byte
+}
+
+func (c *fakeChannel) SendRequest(name string, wantReply bool, payload []byte) (bool, error) {
+	c.name, c.wantReply, c.payload = name, wantReply, payload
+	return c.reply, nil
+}
+
+func TestSendExitStatus(t *testing.T) {
+	ch := &fakeChannel{}
+	if err := SendExitStatus(ch, 130); err != nil {
+		t.Fatal(err)
+	}
+	if ch.name != ExitStatus || ch.wantReply {
+		t.Fatalf("sent %q wantReply=%v, want %q wantReply=false", ch.name, ch.wantReply, ExitStatus)
+	}
+	msg := &ExitStatusMsg{}
+	if err := ssh.Unmarshal(ch.payload, msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Status != 130 {
+		t.Fatalf("status = %d, want 130", msg.Status)
+	}
+}
+
+func TestSendExitSignal(t *testing.T) {
+	ch := &fakeChannel{}
+	if err := SendExitSignal(ch, SIGSEGV, true, "segmentation fault"); err != nil {
+		t.Fatal(err)
+	}
+	if ch.name != ExitSignal || ch.wantReply {
+		t.Fatalf("sent %q wantReply=%v, want %q wantReply=false", ch.name, ch.wantReply, ExitSignal)
+	}
+	msg := &ExitSignalMsg{}
+	if err := ssh.Unmarshal(ch.payload, msg); err != nil {
+		t.Fatal(err)
+	}
+	want := ExitSignalMsg{Signal: SIGSEGV, CoreDumped: true, Error: "segmentation fault"}
+	if *msg != want {
+		t.Fatalf("exit-signal = %+v, want %+v", *msg, want)
+	}
+}
+
+func TestSendMarshaledRequest(t *testing.T) {
+	ch := &fakeChannel{reply: true}
+	if err := SendMarshaledRequest(ch, "keepalive@openssh.com", true, nil); err != nil {
+		t.Fatal(err)
+	}
+	if ch.payload != nil {
+		t.Fatalf("payload = %v, want nil", ch.payload)
+	}
+
+	ch = &fakeChannel{reply: false}
+	if err := SendMarshaledRequest(ch, ReqWinCh, true, &PtyWindowChangeMsg{Columns: 80, Rows: 24}); !errors.Is(err, RequestRejectedErr) {
+		t.Fatalf("err = %v, want RequestRejectedErr", err)
+	}
+	msg := &PtyWindowChangeMsg{}
+	if err := ssh.Unmarshal(ch.payload, msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Columns != 80 || msg.Rows != 24 {
+		t.Fatalf("window-change = %+v, want 80x24", *msg)
+	}
+
+	// 不需要回复的请求不关心对方是否接受
+	ch = &fakeChannel{reply: false}
+	if err := SendMarshaledRequest(ch, ExitStatus, false, &ExitStatusMsg{}); err != nil {
+		t.Fatalf("err = %v, want nil", err)
+	}
+}
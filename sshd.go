@@ -2,12 +2,17 @@ package gosshd
 
 import (
 	"context"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"golang.org/x/crypto/ssh"
 	"io/ioutil"
 	"net"
+	"os"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const (
@@ -30,6 +35,39 @@ type SSHConnLogCallback func(ctx Context) error
 // LookupUserCallback 根据用户名，获取用户详细数据实例
 type LookupUserCallback func(metadata ConnMetadata) (*User, error)
 
+// LookupUserCallbackCtx 与 LookupUserCallback 相同，但是接收一个 context，
+// 当 ctx 被取消（例如超过 UserLookupTimeout）时，应该尽快中止查询并返回
+type LookupUserCallbackCtx func(ctx context.Context, metadata ConnMetadata) (*User, error)
+
+// AuthorizeConnCallback 通过身份认证并获取用户信息之后、处理任何 channel 之前调用，用于实现访问控制策略，
+// 例如只允许某个用户从特定的地址登陆；此时的 ctx 中已经包含了用户、地址以及权限信息；
+// 当返回的 error 不为 nil 时，将拒绝该连接，由 SSHConnFailedLogCallback 记录原因，并关闭 SSH 连接。
+// 注意：此时握手已经完成，传输已被加密，ssh 包没有提供发送 SSH_MSG_DISCONNECT 的方法，所以客户端只会看到连接被关闭，
+// 无法收到 error 的内容；需要让客户端收到原因的访问控制（例如只依赖地址的策略）应该在 TransformConnCallback 中通过 RejectWithDisconnect 实现
+type AuthorizeConnCallback func(ctx Context) error
+
+// PanicCallback 连接、channel 以及请求的处理函数发生 panic 时调用，用于记录 panic 信息；
+// value 为 recover() 的返回值，stack 为发生 panic 的协程的调用栈
+type PanicCallback func(ctx Context, value interface{}, stack []byte)
+
+// UnknownGlobalRequestCallback 接收到没有注册处理函数的全局请求时，在拒绝该请求之前调用，用于记录客户端的请求
+type UnknownGlobalRequestCallback func(reqType string, payload []byte)
+
+// UnknownChannelCallback 接收到没有注册处理函数的 channel 建立请求时，在拒绝该请求之前调用
+type UnknownChannelCallback func(chType string, extraData []byte)
+
+// RejectedChannelCallback 服务端拒绝 channel 建立请求时调用，包括未注册处理函数的类型以及被 ChannelOpenPolicy 拒绝的请求，
+// 用于统计客户端请求的功能（例如 x11、tun@openssh.com）；channel 处理函数自行拒绝的请求不会触发
+type RejectedChannelCallback func(ctx Context, chType string)
+
+// ChannelOpenPolicy 在根据类型分发 channel 建立请求之前调用，reject 为 true 时以 reason 与 msg 拒绝该请求；
+// 可以根据 ctx 中的用户、权限等信息进行控制，例如只允许通过公钥认证的用户建立 direct-tcpip 通道
+type ChannelOpenPolicy func(ctx Context, chType string, extra []byte) (reject bool, reason RejectionReason, msg string)
+
+// GlobalRequestPolicy 在根据类型分发全局请求之前调用，reject 为 true 时拒绝该请求；
+// 与 ChannelOpenPolicy 相同，对之后注册的处理函数同样有效
+type GlobalRequestPolicy func(ctx Context, reqType string, payload []byte) (reject bool)
+
 // GlobalRequestCallback 当成功建立连接后，对于全局请求的处理，例如 “tcpip-forward” 以及 “cancel-tcpip-forward“ 等请求处理，
 // 这类要求通常是为了客户端让服务端向客户端打开一个通道，进行数据转发。
 type GlobalRequestCallback func(ctx Context, request Request)
@@ -46,17 +84,65 @@ type SSHServer struct {
 	// 用于建立连接后，通过用户名，找到用户信息，如果返回的 err 不为 nil，则将终止连接
 	LookupUserCallback
 
+	// 与 LookupUserCallback 相同，但是可以感知超时；设置后将代替 LookupUserCallback
+	LookupUserCallbackCtx
+
+	// 查询用户信息的最长时间，超时后终止该连接，防止缓慢的目录服务（LDAP、NSS 等）占满协程；为 0 时不限制
+	UserLookupTimeout time.Duration
+
+	// 在 LookupUserCallback 之后调用，决定是否允许该连接，与用于记录的 SSHConnLogCallback 区分开
+	AuthorizeConnCallback
+
+	// 两阶段公钥认证的第二阶段，由 SetTwoPhasePublicKeyCallback 设置
+	VerifiedPublicKeyCallback
+
 	// 该字段作用于身份认证之前，对服务器接受的网络连接接口实例进行相应操作，
 	// 用于设置超时、原始数据处理等，也可以返回相应的接口升级实例；如果返回 error 不为 nil 则将终止该连接。
 	TransformConnCallback
-	SSHConnFailedLogCallback                                  // 用于记录 ssh 建立失败原因
-	SSHConnLogCallback                                        // 建立 ssh 连接后的处理函数，如果返回 error 不为 nil，则终止连接
-	GlobalRequestHandlers    map[string]GlobalRequestCallback // 建立 ssh 连接后的处理全局的 request；如果未设置则拒绝其请求
+	SSHConnFailedLogCallback                                      // 用于记录 ssh 建立失败原因
+	SSHConnLogCallback                                            // 建立 ssh 连接后的处理函数，如果返回 error 不为 nil，则终止连接
+	GlobalRequestHandlers        map[string]GlobalRequestCallback // 建立 ssh 连接后的处理全局的 request；如果未设置则拒绝其请求
+	UnknownGlobalRequestCallback                                  // 用于记录被拒绝的未知类型的全局请求
+	UnknownChannelCallback                                        // 用于记录被拒绝的未知类型的 channel 建立请求
+	RejectedChannelCallback                                       // 用于统计被拒绝的 channel 建立请求
+	ChannelOpenPolicy                                             // 在分发 channel 建立请求之前调用，决定是否拒绝该请求
+	GlobalRequestPolicy                                           // 在分发全局请求之前调用，决定是否拒绝该请求
 
 	// 当接收到客户端通道建立请求是，会根据类型由对应的回调函数进行处理。
+	// 与 GlobalRequestHandlers 相同，Serve 之后应当通过 NewChannel、RemoveChannel 修改，直接修改 map 会产生数据竞争
 	NewChannelHandlers map[string]NewChannelHandleFunc // 当 ChannelHandlers 中不存在对应类型 channel 的处理器时，由该 handler 进行处理
 
-	conns map[SSHConn]context.CancelFunc // 已经建立的 SSHConn 连接与取消函数的映射
+	// 处理函数发生 panic 时的回调函数，发生 panic 的连接或 channel 会被关闭，其余连接不受影响
+	PanicCallback
+
+	// 建立 SSH 连接（包括身份认证）的最长时间，超时后关闭该网络连接；为 0 时不限制
+	HandshakeTimeout time.Duration
+
+	// 为 true 时，连接建立后通过 hostkeys-00@openssh.com 请求向客户端告知所有的主机公钥，
+	// 并处理客户端的 hostkeys-prove-00@openssh.com 请求，使客户端可以自动更新 known_hosts
+	AdvertiseHostKeys bool
+
+	// 为 true 时，Context 的 RemoteHost 通过反向解析获取客户端的主机名，与 OpenSSH 的 UseDNS 相同；
+	// 解析可能较慢，所以默认关闭
+	UseDNS bool
+
+	// 单次反向解析的最长时间，为 0 时为 5 秒
+	DNSTimeout time.Duration
+
+	// 为 true 时对接受的 tcp 连接设置 TCP_NODELAY，禁用 Nagle 算法，降低交互式 shell 与端口转发的延迟；
+	// 注意 net 包默认已经设置了 TCP_NODELAY，为 false 时保持连接原有的设置
+	TCPNoDelay bool
+
+	// 大于 0 时对接受的 tcp 连接启用 TCP keepalive 并以其作为探测间隔，使断开的客户端可以被及时发现；
+	// 小于 0 时禁用 keepalive；为 0 时保持 net 包的默认设置
+	TCPKeepAlive time.Duration
+
+	hostSigners       []Signer               // 已加载的主机密钥
+	hostKeyAlgorithms []string               // 允许使用的主机密钥算法，为空时不限制
+	conns             map[SSHConn]*connEntry // 已经建立的 SSHConn 连接与其上下文、取消函数的映射
+	rootCtx           context.Context        // 服务器的根 Context，由 Shutdown 取消
+	rootCancel        context.CancelFunc
+	dnsCache          map[string]dnsCacheEntry // 反向解析结果的缓存
 }
 
 // NewSSHServer 初始化并返回一个 SSHServer 实例
@@ -67,7 +153,7 @@ func NewSSHServer() *SSHServer {
 		ContextBuilder:        NewContext,
 		NewChannelHandlers:    map[string]NewChannelHandleFunc{},
 		GlobalRequestHandlers: map[string]GlobalRequestCallback{},
-		conns:                 map[SSHConn]context.CancelFunc{},
+		conns:                 map[SSHConn]*connEntry{},
 	}
 	server.ServerVersion = "SSH-2.0-GoSSHD"
 	return server
@@ -83,6 +169,86 @@ func (sshd *SSHServer) SetVersion(version int, suffix string) {
 	}
 }
 
+// ApplyPreferredAlgorithms 使用 PreferredKexAlgos、PreferredCiphers 以及 PreferredMACs 作为协商时的算法列表
+func (sshd *SSHServer) ApplyPreferredAlgorithms() {
+	sshd.Config.KeyExchanges = append([]string(nil), PreferredKexAlgos...)
+	sshd.Config.Ciphers = append([]string(nil), PreferredCiphers...)
+	sshd.Config.MACs = append([]string(nil), PreferredMACs...)
+}
+
+// UseHardenedAlgorithms 只使用 HardenedKexAlgos、HardenedCiphers 以及 HardenedMACs 中的算法，
+// 禁用 arcfour、3des-cbc、aes128-cbc 以及 diffie-hellman-group*-sha1 等较弱的算法；
+// 不支持这些算法的旧客户端将无法建立连接
+func (sshd *SSHServer) UseHardenedAlgorithms() {
+	sshd.Config.KeyExchanges = append([]string(nil), HardenedKexAlgos...)
+	sshd.Config.Ciphers = append([]string(nil), HardenedCiphers...)
+	sshd.Config.MACs = append([]string(nil), HardenedMACs...)
+}
+
+// SetCiphers 设置协商时使用的加密算法，顺序即为优先级；
+// 包含 SupportedCiphers 之外的算法时返回 UnsupportedAlgorithmError，且不做任何修改
+func (sshd *SSHServer) SetCiphers(ciphers []string) error {
+	if err := checkAlgorithms("cipher", ciphers, SupportedCiphers); err != nil {
+		return err
+	}
+	sshd.Config.Ciphers = append([]string(nil), ciphers...)
+	return nil
+}
+
+// SetKexAlgorithms 设置协商时使用的密钥交换算法，顺序即为优先级；
+// 包含 SupportedKexAlgos 之外的算法时返回 UnsupportedAlgorithmError，且不做任何修改
+func (sshd *SSHServer) SetKexAlgorithms(kexAlgos []string) error {
+	if err := checkAlgorithms("kex", kexAlgos, SupportedKexAlgos); err != nil {
+		return err
+	}
+	sshd.Config.KeyExchanges = append([]string(nil), kexAlgos...)
+	return nil
+}
+
+// SetMACs 设置协商时使用的消息摘要算法，顺序即为优先级；
+// 包含 SupportedMACs 之外的算法时返回 UnsupportedAlgorithmError，且不做任何修改
+func (sshd *SSHServer) SetMACs(macs []string) error {
+	if err := checkAlgorithms("mac", macs, SupportedMACs); err != nil {
+		return err
+	}
+	sshd.Config.MACs = append([]string(nil), macs...)
+	return nil
+}
+
+// SetHostKeyAlgorithms 限制可以使用的主机密钥算法，只有签名算法包含在 algos 中的主机密钥才会被用于协商，
+// 之后加载的主机密钥同样受此限制；algos 为空时不做限制。
+// 注意：协商时以客户端的算法顺序为准，且 RSA 密钥总是同时提供 rsa-sha2-256、rsa-sha2-512 以及 ssh-rsa 算法；
+// 包含 SupportedHostKeyAlgos 之外的算法时返回 UnsupportedAlgorithmError，且不做任何修改
+func (sshd *SSHServer) SetHostKeyAlgorithms(algos []string) error {
+	if err := checkAlgorithms("host key", algos, SupportedHostKeyAlgos); err != nil {
+		return err
+	}
+	sshd.Lock()
+	defer sshd.Unlock()
+	sshd.hostKeyAlgorithms = append([]string(nil), algos...)
+	sshd.resetHostKeys()
+	return nil
+}
+
+// checkAlgorithms 检查 algos 中的算法是否均包含在 supported 中
+func checkAlgorithms(kind string, algos, supported []string) error {
+	for _, algo := range algos {
+		if !containsString(supported, algo) {
+			return UnsupportedAlgorithmError{Kind: kind, Algorithm: algo}
+		}
+	}
+	return nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
 // SetPasswdCallback 设置密码认证处理回调函数
 func (sshd *SSHServer) SetPasswdCallback(cb PasswdCallback) {
 	sshd.PasswordCallback = WrapPasswdCallback(cb)
@@ -93,6 +259,58 @@ func (sshd *SSHServer) SetPublicKeyCallback(cb PublicKeyCallback) {
 	sshd.PublicKeyCallback = WrapPublicKeyCallback(cb)
 }
 
+// SetTwoPhasePublicKeyCallback 设置两阶段的公钥认证，用于由外部的密钥授权服务决定公钥是否可信的场景：
+// ssh 包在客户端查询公钥是否可用时就会调用公钥认证回调函数，并缓存其结果，所以无法区分查询与实际的认证；
+// known 作为公钥认证回调函数，只应当进行廉价的检查，例如公钥是否属于该用户；
+// verified 只在签名验证通过之后调用，代价较高的检查（例如请求外部服务）应当放在其中，返回 error 时终止连接。
+// 两个阶段之间通过 Permissions 的 Extensions 中的 PublicKeyExtension 传递公钥
+func (sshd *SSHServer) SetTwoPhasePublicKeyCallback(known PublicKeyCallback, verified VerifiedPublicKeyCallback) {
+	sshd.PublicKeyCallback = WrapPublicKeyCallback(func(conn ConnMetadata, key PublicKey) (*Permissions, error) {
+		perms, err := known(conn, key)
+		if err != nil {
+			return nil, err
+		}
+		marked := &Permissions{Extensions: map[string]string{}}
+		if perms != nil {
+			marked.CriticalOptions = perms.CriticalOptions
+			for k, v := range perms.Extensions {
+				marked.Extensions[k] = v
+			}
+		}
+		marked.Extensions[PublicKeyExtension] = string(key.Marshal())
+		return marked, nil
+	})
+	sshd.VerifiedPublicKeyCallback = verified
+}
+
+// verifyPublicKey 调用两阶段公钥认证的第二阶段，并以其返回的 Permissions 代替 sshConn 的 Permissions；
+// 未通过公钥认证的连接直接返回 nil
+func (sshd *SSHServer) verifyPublicKey(sshConn *ssh.ServerConn) error {
+	if sshd.VerifiedPublicKeyCallback == nil || sshConn.Permissions == nil {
+		return nil
+	}
+	keyData, ok := sshConn.Permissions.Extensions[PublicKeyExtension]
+	if !ok {
+		return nil
+	}
+	key, err := ssh.ParsePublicKey([]byte(keyData))
+	if err != nil {
+		return err
+	}
+	perms, err := sshd.VerifiedPublicKeyCallback(sshConn, key, &Permissions{
+		CriticalOptions: sshConn.Permissions.CriticalOptions,
+		Extensions:      sshConn.Permissions.Extensions,
+	})
+	if err != nil {
+		return err
+	}
+	if perms == nil {
+		perms = &Permissions{}
+	}
+	sshConn.Permissions = &ssh.Permissions{CriticalOptions: perms.CriticalOptions, Extensions: perms.Extensions}
+	return nil
+}
+
 // SetKeyboardInteractiveChallengeCallback 设置轮询问答认证处理回调函数
 func (sshd *SSHServer) SetKeyboardInteractiveChallengeCallback(cb KeyboardInteractiveChallengeCallback) {
 	sshd.KeyboardInteractiveCallback = WrapKeyboardInteractiveChallenger(cb)
@@ -110,32 +328,133 @@ func (sshd *SSHServer) SetBannerCallback(cb BannerCallback) {
 
 // NewChannel 添加对应类型的 channel 请求处理函数
 func (sshd *SSHServer) NewChannel(ctype string, handleFunc NewChannelHandleFunc) {
+	sshd.Lock()
+	defer sshd.Unlock()
 	sshd.NewChannelHandlers[ctype] = handleFunc
 }
 
+// ChannelHandler 返回对应类型的 channel 请求处理函数
+func (sshd *SSHServer) ChannelHandler(ctype string) (NewChannelHandleFunc, bool) {
+	sshd.Lock()
+	defer sshd.Unlock()
+	handleFunc, ok := sshd.NewChannelHandlers[ctype]
+	return handleFunc, ok
+}
+
+// RemoveChannel 移除对应类型的 channel 请求处理函数，之后该类型的 channel 建立请求将被拒绝，已经建立的 channel 不受影响；
+// 可用于在运行时关闭某项功能，例如维护期间禁止端口转发
+func (sshd *SSHServer) RemoveChannel(ctype string) {
+	sshd.Lock()
+	defer sshd.Unlock()
+	delete(sshd.NewChannelHandlers, ctype)
+}
+
 // NewGlobalRequest 添加对应类型的 global request 请求处理函数
 func (sshd *SSHServer) NewGlobalRequest(ctype string, handleFunc GlobalRequestCallback) {
+	sshd.Lock()
+	defer sshd.Unlock()
 	sshd.GlobalRequestHandlers[ctype] = handleFunc
 }
 
-func (sshd *SSHServer) addSSHConnWithCancel(conn SSHConn, cancelFunc context.CancelFunc) {
+// GlobalRequestHandler 返回对应类型的 global request 请求处理函数
+func (sshd *SSHServer) GlobalRequestHandler(ctype string) (GlobalRequestCallback, bool) {
+	sshd.Lock()
+	defer sshd.Unlock()
+	handleFunc, ok := sshd.GlobalRequestHandlers[ctype]
+	return handleFunc, ok
+}
+
+// RemoveGlobalRequest 移除对应类型的 global request 请求处理函数，之后该类型的全局请求将被拒绝
+func (sshd *SSHServer) RemoveGlobalRequest(ctype string) {
+	sshd.Lock()
+	defer sshd.Unlock()
+	delete(sshd.GlobalRequestHandlers, ctype)
+}
+
+// SetNewChanHandleFunc 与 NewChannel 相同，保留该名称以兼容 readme 以及旧版本中的用法
+func (sshd *SSHServer) SetNewChanHandleFunc(ctype string, handleFunc NewChannelHandleFunc) {
+	sshd.NewChannel(ctype, handleFunc)
+}
+
+// SetGlobalRequestHandleFunc 与 NewGlobalRequest 相同，保留该名称以兼容 readme 以及旧版本中的用法
+func (sshd *SSHServer) SetGlobalRequestHandleFunc(ctype string, handleFunc GlobalRequestCallback) {
+	sshd.NewGlobalRequest(ctype, handleFunc)
+}
+
+// connEntry 已建立的 SSH 连接的相关数据
+type connEntry struct {
+	ctx         Context
+	cancel      context.CancelFunc
+	connectedAt time.Time
+	counter     *countingConn // 用于统计连接传输的字节数
+}
+
+func (sshd *SSHServer) addSSHConnWithCancel(conn SSHConn, ctx Context, cancelFunc context.CancelFunc, counter *countingConn) {
 	sshd.Lock()
 	defer sshd.Unlock()
 	if sshd.conns == nil {
-		sshd.conns = make(map[SSHConn]context.CancelFunc)
+		sshd.conns = make(map[SSHConn]*connEntry)
 	}
-	sshd.conns[conn] = cancelFunc
+	sshd.conns[conn] = &connEntry{ctx: ctx, cancel: cancelFunc, connectedAt: time.Now(), counter: counter}
 }
 
 // DelSSHConn 执行 conn 对应的cancel 并删除 conn
 func (sshd *SSHServer) DelSSHConn(conn SSHConn) {
 	sshd.Lock()
-	defer sshd.Unlock()
-	if cancel, ok := sshd.conns[conn]; ok {
-		cancel()
+	entry, ok := sshd.conns[conn]
+	delete(sshd.conns, conn)
+	sshd.Unlock()
+	if ok {
+		entry.cancel()
 		conn.Close() // fixme 一般情况下只有关闭的  conn 才能运行到此处，为了保险再次进行关闭
 	}
-	delete(sshd.conns, conn)
+}
+
+// sshConns 返回当前所有已建立的 SSHConn
+func (sshd *SSHServer) sshConns() []SSHConn {
+	sshd.Lock()
+	defer sshd.Unlock()
+	conns := make([]SSHConn, 0, len(sshd.conns))
+	for conn := range sshd.conns {
+		conns = append(conns, conn)
+	}
+	return conns
+}
+
+// ActiveConns 返回当前所有已建立的 SSH 连接的信息
+func (sshd *SSHServer) ActiveConns() []ConnInfo {
+	sshd.Lock()
+	defer sshd.Unlock()
+	infos := make([]ConnInfo, 0, len(sshd.conns))
+	for conn, entry := range sshd.conns {
+		info := ConnInfo{
+			SessionID:     hex.EncodeToString(conn.SessionID()),
+			User:          conn.User(),
+			RemoteAddr:    conn.RemoteAddr(),
+			LocalAddr:     conn.LocalAddr(),
+			ClientVersion: string(conn.ClientVersion()),
+			ConnectedAt:   entry.connectedAt,
+			BytesIn:       entry.counter.BytesIn(),
+			BytesOut:      entry.counter.BytesOut(),
+		}
+		if user := entry.ctx.User(); user != nil {
+			info.User = user.UserName
+		}
+		infos = append(infos, info)
+	}
+	return infos
+}
+
+// Disconnect 关闭会话标识为 sessionID（ConnInfo 中 hex 编码的形式）的 SSH 连接，并取消其处理协程；
+// 连接不存在时返回 ConnNotFoundErr
+func (sshd *SSHServer) Disconnect(sessionID string) error {
+	for _, conn := range sshd.sshConns() {
+		if hex.EncodeToString(conn.SessionID()) == sessionID {
+			sshd.DelSSHConn(conn)
+			return nil
+		}
+	}
+	return ConnNotFoundErr
 }
 
 // AddHostKey 加载密钥，hostkey 应该是服务端私钥文件的全部内容
@@ -147,7 +466,7 @@ func (sshd *SSHServer) AddHostKey(hostKey []byte) error {
 	if err != nil {
 		return err
 	}
-	sshd.ServerConfig.AddHostKey(private)
+	sshd.addHostSigner(private)
 	return nil
 }
 
@@ -156,7 +475,76 @@ func (sshd *SSHServer) AddHostKey(hostKey []byte) error {
 func (sshd *SSHServer) AddHostSigner(signer Signer) {
 	sshd.Lock()
 	defer sshd.Unlock()
-	sshd.ServerConfig.AddHostKey(signer)
+	sshd.addHostSigner(signer)
+}
+
+// addHostSigner 添加主机密钥，与 ssh.ServerConfig 的 AddHostKey 相同，会替换相同算法的密钥；调用者需要持有锁
+func (sshd *SSHServer) addHostSigner(signer Signer) {
+	if sshd.hostKeyAllowed(signer) {
+		sshd.ServerConfig.AddHostKey(signer)
+	}
+	for i, s := range sshd.hostSigners {
+		if s.PublicKey().Type() == signer.PublicKey().Type() {
+			sshd.hostSigners[i] = signer
+			return
+		}
+	}
+	sshd.hostSigners = append(sshd.hostSigners, signer)
+}
+
+// hostKeyAllowed 判断主机密钥是否可以用于协商；调用者需要持有锁
+func (sshd *SSHServer) hostKeyAllowed(signer Signer) bool {
+	if len(sshd.hostKeyAlgorithms) == 0 {
+		return true
+	}
+	for _, algo := range hostKeyAlgorithms(signer.PublicKey().Type()) {
+		if containsString(sshd.hostKeyAlgorithms, algo) {
+			return true
+		}
+	}
+	return false
+}
+
+// resetHostKeys 根据 hostKeyAlgorithms 重新设置 ssh.ServerConfig 中的主机密钥；调用者需要持有锁。
+// ssh.ServerConfig 没有提供删除主机密钥的方法，所以需要重新创建 ServerConfig 并复制其余的配置
+func (sshd *SSHServer) resetHostKeys() {
+	old := sshd.ServerConfig
+	sshd.ServerConfig = ssh.ServerConfig{
+		Config:                      old.Config,
+		NoClientAuth:                old.NoClientAuth,
+		MaxAuthTries:                old.MaxAuthTries,
+		PasswordCallback:            old.PasswordCallback,
+		PublicKeyCallback:           old.PublicKeyCallback,
+		KeyboardInteractiveCallback: old.KeyboardInteractiveCallback,
+		AuthLogCallback:             old.AuthLogCallback,
+		ServerVersion:               old.ServerVersion,
+		BannerCallback:              old.BannerCallback,
+		GSSAPIWithMICConfig:         old.GSSAPIWithMICConfig,
+	}
+	for _, signer := range sshd.hostSigners {
+		if sshd.hostKeyAllowed(signer) {
+			sshd.ServerConfig.AddHostKey(signer)
+		}
+	}
+}
+
+// HostSigners 返回已经加载的、可以用于协商的所有主机密钥
+func (sshd *SSHServer) HostSigners() []Signer {
+	sshd.Lock()
+	defer sshd.Unlock()
+	signers := make([]Signer, 0, len(sshd.hostSigners))
+	for _, signer := range sshd.hostSigners {
+		if sshd.hostKeyAllowed(signer) {
+			signers = append(signers, signer)
+		}
+	}
+	return signers
+}
+
+// HostKeyCount 返回已经加载的、可以用于协商的主机密钥数量；为 0 时客户端无法完成握手，
+// 部分主机密钥可能加载失败时（例如 LoadHostKeysFromDir），可在 Serve 之前检查至少加载了一个密钥
+func (sshd *SSHServer) HostKeyCount() int {
+	return len(sshd.HostSigners())
 }
 
 // LoadHostKey 从指定的文件中加载密钥，
@@ -174,69 +562,214 @@ func (sshd *SSHServer) LoadHostKey(path string) error {
 // 所以需要保证开启的协程可以成功接收到 Context Done() 方法的信号，并退出协程
 func (sshd *SSHServer) Close() error {
 	err := sshd.listener.Close()
-	for con, _ := range sshd.conns {
+	for _, con := range sshd.sshConns() {
 		err = con.Close()
 		sshd.DelSSHConn(con)
 	}
 	return err
 }
 
-// Shutdown 关闭服务器，调用所有连接产生的 cancelFunc，尝试取消所有的处理协程
-func (sshd *SSHServer) Shutdown() error {
+// Context 返回服务器的根 Context，NewContext 从其派生每个连接的 Context；
+// 调用 Shutdown 时被取消，可用于在处理函数之外拨号或者传递给其它库，使其随服务器关闭而取消
+func (sshd *SSHServer) Context() context.Context {
 	sshd.Lock()
 	defer sshd.Unlock()
+	if sshd.rootCtx == nil {
+		sshd.rootCtx, sshd.rootCancel = context.WithCancel(context.Background())
+	}
+	return sshd.rootCtx
+}
+
+// Shutdown 关闭服务器，取消服务器的根 Context，并调用所有连接产生的 cancelFunc，尝试取消所有的处理协程；
+// 之后再次调用 Serve 时将使用新的根 Context
+func (sshd *SSHServer) Shutdown() error {
+	sshd.Lock()
 	err := sshd.listener.Close()
 	sshd.listener = nil
+	if sshd.rootCancel != nil {
+		sshd.rootCancel()
+		sshd.rootCtx, sshd.rootCancel = nil, nil
+	}
+	sshd.Unlock()
 
-	// 遍历所有的 sshConn 对应的 cancel， 并执行
-	for con, cancel := range sshd.conns {
-		cancel()
-		err := con.Close()
+	// 遍历所有的 sshConn，执行对应的 cancel，并关闭连接
+	for _, con := range sshd.sshConns() {
 		sshd.DelSSHConn(con)
-		if err != nil {
-			return err
-		}
 	}
 	return err
 }
 
+// AllowNoAuth 设置是否允许客户端不经过身份认证即可建立连接，即 ssh.ServerConfig 的 NoClientAuth；
+// 注意：开启后任何人都可以以任意用户名登陆，LookupUserCallback 返回的用户将获得该用户的 shell 等权限，
+// 只应该用于测试，或者在 TransformConnCallback、AuthorizeConnCallback 等回调函数中已经进行了访问控制的场景
+func (sshd *SSHServer) AllowNoAuth(allow bool) {
+	sshd.NoClientAuth = allow
+}
+
+// authConfigured 是否设置了身份认证回调函数，或者明确允许不经过身份认证
+func (sshd *SSHServer) authConfigured() bool {
+	return sshd.NoClientAuth || sshd.PasswordCallback != nil || sshd.PublicKeyCallback != nil ||
+		sshd.KeyboardInteractiveCallback != nil || sshd.GSSAPIWithMICConfig != nil
+}
+
+// Validate 在不监听端口的情况下检查服务器的配置：是否加载了主机密钥、是否设置了 ContextBuilder、
+// 是否设置了身份认证回调函数（或者明确设置了 NoClientAuth）以及是否注册了 channel 处理函数；
+// 存在问题时返回包含所有问题的 ConfigError，可以在启动时调用以尽早发现错误的配置
+func (sshd *SSHServer) Validate() error {
+	var problems []string
+	if len(sshd.HostSigners()) == 0 {
+		problems = append(problems, "no host keys")
+	}
+	if sshd.ContextBuilder == nil {
+		problems = append(problems, "no context builder")
+	}
+	if !sshd.authConfigured() {
+		problems = append(problems, NoAuthMethodsErr.Error())
+	}
+	sshd.Lock()
+	noChannelHandlers := len(sshd.NewChannelHandlers) == 0
+	sshd.Unlock()
+	if noChannelHandlers {
+		problems = append(problems, "no channel handlers")
+	}
+	if len(problems) > 0 {
+		return ConfigError{Problems: problems}
+	}
+	return nil
+}
+
 // ListenAndServe 监听tcp网络并启动 SSH 服务
-// network 为 "tcp", "tcp4", "tcp6", "unix" or "unixpacket"
 func (sshd *SSHServer) ListenAndServe(address string) error {
-	listener, err := net.Listen("tcp", address)
+	return sshd.ListenAndServeNetwork("tcp", address)
+}
+
+// ListenAndServeNetwork 监听指定的网络并启动 SSH 服务，
+// network 为 "tcp", "tcp4", "tcp6", "unix" or "unixpacket"，unix 网络的 address 为 socket 文件路径
+func (sshd *SSHServer) ListenAndServeNetwork(network, address string) error {
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		return err
+	}
+	return sshd.Serve(listener)
+}
+
+// ServeSystemd 使用 systemd socket activation 传入的第一个监听 socket 启动 SSH 服务，
+// 需要在 .socket unit 中配置 ListenStream；未通过 socket activation 启动时返回 NoSystemdSocketErr
+func (sshd *SSHServer) ServeSystemd() error {
+	listener, err := systemdListener()
 	if err != nil {
 		return err
 	}
 	return sshd.Serve(listener)
 }
 
-// Serve 使用传入的监听器进行监听，并启动 SSH 服务
+// systemd 传递的第一个文件描述符，See sd_listen_fds(3).
+const listenFdsStart = 3
+
+// systemdListener 根据 LISTEN_PID 与 LISTEN_FDS 环境变量获取 systemd 传入的监听 socket
+func systemdListener() (net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, NoSystemdSocketErr
+	}
+	fds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || fds < 1 {
+		return nil, NoSystemdSocketErr
+	}
+	// 避免由该进程启动的子进程（例如用户的 shell）误认为自己也是通过 socket activation 启动的
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	file := os.NewFile(listenFdsStart, "LISTEN_FD_3")
+	defer file.Close()
+	return net.FileListener(file)
+}
+
+// Serve 使用传入的监听器进行监听，并启动 SSH 服务；
+// Accept 返回临时性错误时以指数退避的方式重试，只有在监听器被关闭等永久性错误时才返回
 func (sshd *SSHServer) Serve(listener net.Listener) error {
 	if sshd.ContextBuilder == nil {
 		return NoContextBuilderErr
 	}
+	// 否则每个连接都会在握手时以难以理解的错误失败
+	if !sshd.authConfigured() {
+		return NoAuthMethodsErr
+	}
 	sshd.listener = listener
+	var tempDelay time.Duration // Accept 临时性错误（例如文件描述符耗尽）之后的等待时间，与 net/http 的 Server.Serve 相同
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
-			return err
-		}
-		// 尝试对网络接口进行转换
-		if sshd.TransformConnCallback != nil {
-			transformedConn, err := sshd.TransformConnCallback(conn)
-			if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if tempDelay == 0 {
+					tempDelay = 5 * time.Millisecond
+				} else {
+					tempDelay *= 2
+				}
+				if max := 1 * time.Second; tempDelay > max {
+					tempDelay = max
+				}
+				time.Sleep(tempDelay)
 				continue
 			}
-			conn = transformedConn
+			return err
+		}
+		tempDelay = 0
+		sshd.configureTCP(conn)
+		go sshd.transformAndHandle(conn)
+	}
+}
+
+// configureTCP 根据 TCPNoDelay 与 TCPKeepAlive 设置 tcp 连接的选项，其它类型的连接不受影响
+func (sshd *SSHServer) configureTCP(conn net.Conn) {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	if sshd.TCPNoDelay {
+		tcpConn.SetNoDelay(true)
+	}
+	if sshd.TCPKeepAlive > 0 {
+		tcpConn.SetKeepAlive(true)
+		tcpConn.SetKeepAlivePeriod(sshd.TCPKeepAlive)
+	} else if sshd.TCPKeepAlive < 0 {
+		tcpConn.SetKeepAlive(false)
+	}
+}
+
+// transformAndHandle 尝试对网络接口进行转换，然后处理该连接；
+// 转换过程可能需要读取网络数据，所以不应该在监听协程中执行
+func (sshd *SSHServer) transformAndHandle(conn net.Conn) {
+	if sshd.TransformConnCallback != nil {
+		transformedConn, err := sshd.TransformConnCallback(conn)
+		if err != nil {
+			conn.Close()
+			return
 		}
-		go sshd.HandleConn(conn)
+		conn = transformedConn
 	}
+	sshd.HandleConn(conn)
 }
 
 func (sshd *SSHServer) HandleConn(conn net.Conn) {
 	ctx, cancel := sshd.ContextBuilder(sshd)
-	// 建立 ssh 连接
-	sshConn, chans, reqs, err := ssh.NewServerConn(conn, &sshd.ServerConfig)
+	var sshConn *ssh.ServerConn
+	// 用户设置的回调函数发生 panic 时，只关闭该连接；已经加入连接列表的连接需要一并删除，否则 ActiveConns 会一直报告该连接
+	defer RecoverPanic(ctx, func() {
+		if sshConn != nil {
+			sshd.DelSSHConn(sshConn)
+		}
+		conn.Close()
+		cancel()
+	})
+	// 防止客户端迟迟不完成握手而一直占用协程
+	if sshd.HandshakeTimeout > 0 {
+		conn.SetDeadline(time.Now().Add(sshd.HandshakeTimeout))
+	}
+	// 建立 ssh 连接，并统计该连接传输的字节数
+	counter := &countingConn{Conn: conn}
+	recorder := &kexInitRecorder{Conn: counter}
+	sshConn, chans, reqs, err := ssh.NewServerConn(recorder, &sshd.ServerConfig)
 	if err != nil {
 		if sshd.SSHConnFailedLogCallback != nil {
 			sshd.SSHConnFailedLogCallback(err, conn)
@@ -244,14 +777,22 @@ func (sshd *SSHServer) HandleConn(conn net.Conn) {
 		conn.Close()
 		return
 	}
-	if sshd.LookupUserCallback != nil {
-		user, err := sshd.LookupUserCallback(sshConn)
+	if sshd.HandshakeTimeout > 0 {
+		conn.SetDeadline(time.Time{})
+	}
+	if err := sshd.verifyPublicKey(sshConn); err != nil {
+		sshd.rejectConn(err, conn, sshConn, cancel)
+		return
+	}
+	if sshd.LookupUserCallbackCtx != nil || sshd.LookupUserCallback != nil {
+		user, err := sshd.lookupUser(ctx, sshConn)
 		if err != nil {
+			sshd.rejectConn(err, conn, sshConn, cancel)
 			return
 		}
 		ctx.SetUser(user)
 	}
-	// 至此已经通过所有校验，添加信息至上下文中
+	// 至此已经通过身份认证，添加信息至上下文中
 	if sshConn.Permissions != nil {
 		ctx.SetPermissions(&Permissions{
 			CriticalOptions: sshConn.Permissions.CriticalOptions,
@@ -265,21 +806,32 @@ func (sshd *SSHServer) HandleConn(conn net.Conn) {
 	ctx.SetServerVersion(string(sshConn.ServerVersion()))
 	ctx.SetClientVersion(string(sshConn.ClientVersion()))
 	ctx.SetConn(sshConn)
+	if algos, ok := recorder.Algorithms(); ok {
+		ctx.SetAlgorithms(algos)
+	}
+
+	// 根据上下文信息决定是否允许该连接
+	if sshd.AuthorizeConnCallback != nil {
+		if err := sshd.AuthorizeConnCallback(ctx); err != nil {
+			sshd.rejectConn(err, conn, sshConn, cancel)
+			return
+		}
+	}
 
 	if sshd.SSHConnLogCallback != nil {
 		err := sshd.SSHConnLogCallback(ctx)
 		if err != nil {
 			sshConn.Close()
+			cancel()
 			return
 		}
 	}
-	sshd.addSSHConnWithCancel(sshConn, cancel)
+	sshd.addSSHConnWithCancel(sshConn, ctx, cancel, counter)
 
-	// 全局请求处理
-	if sshd.GlobalRequestHandlers != nil {
-		go sshd.serveGlobalRequest(ctx, reqs)
-	} else {
-		go DiscardRequests(ctx, reqs)
+	// 全局请求处理，未注册处理函数的请求将被拒绝
+	go sshd.serveGlobalRequest(ctx, reqs)
+	if sshd.AdvertiseHostKeys {
+		go sshd.SendHostKeys(ctx)
 	}
 
 	// 并发处理每一个客户端请求建立的 Channel
@@ -291,10 +843,21 @@ func (sshd *SSHServer) HandleConn(conn net.Conn) {
 				goto del // 连接已经关闭，删除该 SSHConn
 			}
 			//fmt.Println("channel:", newChannel.ChannelType())
-			if handle, ok := sshd.NewChannelHandlers[newChannel.ChannelType()]; ok {
-				go handle(ctx, newChannel)
+			if sshd.ChannelOpenPolicy != nil {
+				if reject, reason, msg := sshd.ChannelOpenPolicy(ctx, newChannel.ChannelType(), newChannel.ExtraData()); reject {
+					newChannel.Reject(ssh.RejectionReason(reason), msg)
+					sshd.channelRejected(ctx, newChannel.ChannelType())
+					continue
+				}
+			}
+			if handle, ok := sshd.ChannelHandler(newChannel.ChannelType()); ok {
+				go sshd.serveChannel(ctx, handle, newChannel)
 			} else {
+				if sshd.UnknownChannelCallback != nil {
+					sshd.UnknownChannelCallback(newChannel.ChannelType(), newChannel.ExtraData())
+				}
 				newChannel.Reject(UnknownChannelType, fmt.Sprintf("not support %s", newChannel.ChannelType()))
+				sshd.channelRejected(ctx, newChannel.ChannelType())
 			}
 		case <-ctx.Done(): // 当 Context 的 cancelFunc 被调用时，退出函数
 			goto del
@@ -304,6 +867,67 @@ del: // 删除
 	sshd.DelSSHConn(sshConn)
 }
 
+// channelRejected 设置了 RejectedChannelCallback 时，记录被拒绝的 channel 类型
+func (sshd *SSHServer) channelRejected(ctx Context, chType string) {
+	if sshd.RejectedChannelCallback != nil {
+		sshd.RejectedChannelCallback(ctx, chType)
+	}
+}
+
+// lookupUser 在 UserLookupTimeout 时间内查询用户信息，超时返回 UserLookupTimeoutErr；
+// 只设置了 LookupUserCallback 时，无法中止查询，超时后查询协程会继续运行直至回调函数返回
+func (sshd *SSHServer) lookupUser(ctx Context, metadata ConnMetadata) (*User, error) {
+	c, cancel := context.Context(ctx), context.CancelFunc(func() {})
+	if sshd.UserLookupTimeout > 0 {
+		c, cancel = context.WithTimeout(ctx, sshd.UserLookupTimeout)
+	}
+	defer cancel()
+
+	type result struct {
+		user *User
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		defer RecoverPanic(ctx, func() {
+			done <- result{err: UserLookupPanicErr}
+		})
+		var r result
+		if sshd.LookupUserCallbackCtx != nil {
+			r.user, r.err = sshd.LookupUserCallbackCtx(c, metadata)
+		} else {
+			r.user, r.err = sshd.LookupUserCallback(metadata)
+		}
+		done <- r
+	}()
+	select {
+	case r := <-done:
+		return r.user, r.err
+	case <-c.Done():
+		if errors.Is(c.Err(), context.DeadlineExceeded) {
+			return nil, UserLookupTimeoutErr
+		}
+		return nil, c.Err()
+	}
+}
+
+// serveChannel 调用 channel 处理函数，处理函数发生 panic 时，只关闭（或拒绝）对应的 channel
+func (sshd *SSHServer) serveChannel(ctx Context, handle NewChannelHandleFunc, newChannel ssh.NewChannel) {
+	c := &recoverableNewChannel{NewChannel: newChannel}
+	defer RecoverPanic(ctx, c.abort)
+	handle(ctx, c)
+}
+
+// rejectConn 拒绝一个已经通过身份认证的 SSH 连接，调用 SSHConnFailedLogCallback 记录原因，并关闭连接；
+// 握手之后的数据包由 ssh 包加密，而 ssh 包不允许写入 SSH_MSG_DISCONNECT，所以 reason 不会发送给客户端
+func (sshd *SSHServer) rejectConn(reason error, conn net.Conn, sshConn SSHConn, cancel context.CancelFunc) {
+	if sshd.SSHConnFailedLogCallback != nil {
+		sshd.SSHConnFailedLogCallback(reason, conn)
+	}
+	sshConn.Close()
+	cancel()
+}
+
 func (sshd *SSHServer) serveGlobalRequest(ctx Context, requests <-chan *ssh.Request) {
 	for {
 		select {
@@ -314,9 +938,29 @@ func (sshd *SSHServer) serveGlobalRequest(ctx Context, requests <-chan *ssh.Requ
 				return
 			}
 			//fmt.Println("global", request.Type, string(request.Payload))
-			if handler, ok := sshd.GlobalRequestHandlers[request.Type]; ok {
-				go handler(ctx, Request{request})
+			if sshd.GlobalRequestPolicy != nil && sshd.GlobalRequestPolicy(ctx, request.Type, request.Payload) {
+				request.Reply(false, nil)
+				continue
+			}
+			handler, ok := sshd.GlobalRequestHandler(request.Type)
+			if !ok && sshd.AdvertiseHostKeys && request.Type == GlobalReqHostKeysProve {
+				handler, ok = sshd.HandleHostKeysProve, true
+			}
+			if ok {
+				go func(handler GlobalRequestCallback, request *ssh.Request) {
+					// 处理函数发生 panic 时拒绝尚未回复的请求，避免客户端一直等待回复
+					var replied uint32
+					defer RecoverPanic(ctx, func() {
+						if request.WantReply && atomic.LoadUint32(&replied) == 0 {
+							request.Reply(false, nil)
+						}
+					})
+					handler(ctx, Request{Request: request, replied: &replied})
+				}(handler, request)
 			} else {
+				if sshd.UnknownGlobalRequestCallback != nil {
+					sshd.UnknownGlobalRequestCallback(request.Type, request.Payload)
+				}
 				request.Reply(false, nil)
 			}
 		}
@@ -324,3 +968,15 @@ func (sshd *SSHServer) serveGlobalRequest(ctx Context, requests <-chan *ssh.Requ
 }
 
 var NoContextBuilderErr = errors.New("no context builder")
+
+// NoAuthMethodsErr 没有设置任何身份认证回调函数，也没有通过 AllowNoAuth 允许不经过身份认证
+var NoAuthMethodsErr = errors.New("no authentication callbacks set and NoClientAuth is false, use AllowNoAuth to explicitly disable authentication")
+
+// NoSystemdSocketErr 进程不是通过 systemd socket activation 启动的
+var NoSystemdSocketErr = errors.New("no systemd socket")
+
+var ConnNotFoundErr = errors.New("connection not found")
+
+var UserLookupTimeoutErr = errors.New("user lookup timeout")
+
+var UserLookupPanicErr = errors.New("panic while looking up user")
@@ -0,0 +1,163 @@
+package gosshd
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"golang.org/x/crypto/ssh"
+	"net"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestServer 创建一个不需要身份认证的 SSHServer，并在回环地址上开始监听
+func newTestServer(t *testing.T) (*SSHServer, string) {
+	sshd := NewSSHServer()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sshd.AddHostSigner(signer)
+	sshd.AllowNoAuth(true)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go sshd.Serve(listener)
+	t.Cleanup(func() { sshd.Close() })
+	return sshd, listener.Addr().String()
+}
+
+// TestHandlerRegistrationWhileServing 在处理连接的同时注册与移除处理函数，需要以 -race 运行
+func TestHandlerRegistrationWhileServing(t *testing.T) {
+	sshd, addr := newTestServer(t)
+	const chType, reqType = "test@gosshd", "test-request@gosshd"
+	handleChannel := func(ctx Context, c NewChannel) {
+		c.Reject(ssh.Prohibited, "test")
+	}
+	handleRequest := func(ctx Context, request Request) {
+		request.Reply(true, nil)
+	}
+
+	done := make(chan struct{})
+	registered := make(chan struct{})
+	go func() {
+		defer close(registered)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			sshd.NewChannel(chType, handleChannel)
+			sshd.NewGlobalRequest(reqType, handleRequest)
+			sshd.RemoveChannel(chType)
+			sshd.RemoveGlobalRequest(reqType)
+			runtime.Gosched()
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			client, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{User: "test", HostKeyCallback: ssh.InsecureIgnoreHostKey()})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer client.Close()
+			for j := 0; j < 20; j++ {
+				// 处理函数随时可能被移除，所以只关心是否发生数据竞争，不关心请求是否被接受
+				if _, _, err := client.OpenChannel(chType, nil); err != nil {
+					if _, ok := err.(*ssh.OpenChannelError); !ok {
+						t.Error(err)
+						return
+					}
+				}
+				if _, _, err := client.SendRequest(reqType, true, nil); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(done)
+	<-registered
+}
+
+// TestGlobalRequestPanic 处理函数发生 panic 时，未回复的请求被拒绝，已经回复的请求不会再次回复
+func TestGlobalRequestPanic(t *testing.T) {
+	sshd, addr := newTestServer(t)
+	sshd.PanicCallback = func(ctx Context, value interface{}, stack []byte) {}
+	sshd.NewGlobalRequest("panic@gosshd", func(ctx Context, request Request) {
+		panic("test")
+	})
+	sshd.NewGlobalRequest("reply-panic@gosshd", func(ctx Context, request Request) {
+		request.Reply(true, nil)
+		panic("test")
+	})
+	client, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{User: "test", HostKeyCallback: ssh.InsecureIgnoreHostKey()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	// 客户端按顺序匹配回复，重复的回复会被当作下一个请求的回复
+	for i := 0; i < 3; i++ {
+		if ok, _, err := client.SendRequest("panic@gosshd", true, nil); ok || err != nil {
+			t.Fatalf("panic@gosshd: ok = %v, err = %v, want rejected", ok, err)
+		}
+		if ok, _, err := client.SendRequest("reply-panic@gosshd", true, nil); !ok || err != nil {
+			t.Fatalf("reply-panic@gosshd: ok = %v, err = %v, want accepted", ok, err)
+		}
+	}
+}
+
+// TestConnCallbackPanic 连接回调函数发生 panic 时，该连接从连接列表中删除
+func TestConnCallbackPanic(t *testing.T) {
+	sshd, addr := newTestServer(t)
+	sshd.PanicCallback = func(ctx Context, value interface{}, stack []byte) {}
+	sshd.ChannelOpenPolicy = func(ctx Context, chType string, extra []byte) (bool, RejectionReason, string) {
+		panic("test")
+	}
+	client, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{User: "test", HostKeyCallback: ssh.InsecureIgnoreHostKey()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if _, _, err := client.OpenChannel("test@gosshd", nil); err == nil {
+		t.Fatal("channel opened")
+	}
+	client.Wait()
+	if n := len(sshd.ActiveConns()); n != 0 {
+		t.Fatalf("%d active connections after panic, want 0", n)
+	}
+}
+
+// TestSSHConnLogCallbackError SSHConnLogCallback 返回 error 时，关闭连接并取消该连接的 Context
+func TestSSHConnLogCallbackError(t *testing.T) {
+	sshd, addr := newTestServer(t)
+	contexts := make(chan Context, 1)
+	sshd.SSHConnLogCallback = func(ctx Context) error {
+		contexts <- ctx
+		return errors.New("test")
+	}
+	client, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{User: "test", HostKeyCallback: ssh.InsecureIgnoreHostKey()})
+	if err == nil {
+		client.Wait()
+		client.Close()
+	}
+	select {
+	case <-(<-contexts).Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("context not canceled")
+	}
+}
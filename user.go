@@ -1,5 +1,13 @@
 package gosshd
 
+import (
+	"bufio"
+	"errors"
+	"os"
+	"os/user"
+	"strings"
+)
+
 // User 根据 Unix 系统的 passwd 文件设置的用户字段结构体
 type User struct {
 	UserName     string            // 用户名
@@ -11,3 +19,48 @@ type User struct {
 	Shell        string            // 用户的默认shell
 	Extensions   map[string]string // 可能会用到的额外信息
 }
+
+var InvalidOSUserErr = errors.New("invalid os user")
+
+// UserFromOSUser 将 os/user 包的 User 转换为 User，用于编写不依赖 passwd 文件格式的 LookupUserCallback，例如：
+//
+//	sshd.LookupUserCallback = func(metadata gosshd.ConnMetadata) (*gosshd.User, error) {
+//		u, err := user.Lookup(metadata.User())
+//		if err != nil {
+//			return nil, err
+//		}
+//		return gosshd.UserFromOSUser(u)
+//	}
+//
+// os/user 不提供用户的登陆 shell，存在 /etc/passwd 文件时从中读取，否则 Shell 为空，由调用者使用默认的 shell
+func UserFromOSUser(u *user.User) (*User, error) {
+	if u == nil || u.Username == "" {
+		return nil, InvalidOSUserErr
+	}
+	return &User{
+		UserName:     u.Username,
+		PasswordFlag: "x",
+		Uid:          u.Uid,
+		Gid:          u.Gid,
+		GECOS:        u.Name,
+		HomeDir:      u.HomeDir,
+		Shell:        lookupLoginShell(u.Username, u.Uid),
+	}, nil
+}
+
+// lookupLoginShell 从 /etc/passwd 中读取用户名与 uid 均匹配的记录的登陆 shell，找不到时返回空字符串
+func lookupLoginShell(username, uid string) string {
+	file, err := os.Open("/etc/passwd")
+	if err != nil {
+		return ""
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), ":")
+		if len(fields) == 7 && fields[0] == username && fields[2] == uid {
+			return fields[6]
+		}
+	}
+	return ""
+}